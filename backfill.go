@@ -0,0 +1,208 @@
+package schemamagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	pgx "github.com/jackc/pgx/v5"
+)
+
+// operatorCharacters are the characters of which the operators in expressions are made
+const operatorCharacters = "+-*/<>=~!@#%^&|`?"
+
+// castPattern matches a cast at the start of an expression, including the multi-word type names, the type modifiers and the array brackets
+var castPattern = regexp.MustCompile(`(?i)^::\s*(?:"(?:[^"]|"")+"|[a-z_][a-z0-9_.]*)(?:\s+(?:varying|precision|with|without|time|zone)\b)*(?:\s*\([0-9,\s]*\))?(?:\s*\[\])*`)
+
+// Backfill policies that decide which existing rows are updated when the default value of an existing column changes
+const (
+	BackfillNever = ""      // Existing rows are left untouched (default)
+	BackfillNulls = "nulls" // Only the rows in which the column is NULL are updated
+	BackfillAll   = "all"   // All the rows are updated
+)
+
+// batchedUpdate is a backfill that runs after the transaction is committed, in batches keyed by the primary key of the table
+type batchedUpdate struct {
+	first string        // Updates the first batch
+	next  string        // Updates the batch that follows the primary key passed as $1
+	sleep time.Duration // Time to wait between batches
+}
+
+// validateBackfill checks the backfill policy of the column
+func (c *Column) validateBackfill() error {
+	switch c.Backfill {
+	case BackfillNever, BackfillNulls, BackfillAll:
+	default:
+		return fmt.Errorf("invalid backfill policy %q", c.Backfill)
+	}
+	if c.BackfillBatchSize < 0 {
+		return fmt.Errorf("invalid backfill batch size %d", c.BackfillBatchSize)
+	}
+	return nil
+}
+
+// defaultChanged returns if the declared default differs from the current default of the column. PostgreSQL stores defaults in a normalized form (with casts, parentheses, etc.), so both are compared through normalizeDefault, without running any statement
+func (t *Table) defaultChanged(col Column, state columnState) bool {
+	if state.defaultValue == "" {
+		return true
+	}
+	changed := normalizeDefault(state.defaultValue, t.DefaultSchema) != normalizeDefault(col.DefaultValue, t.DefaultSchema)
+	log.Debugln("Default of column --> ", col.Name, " is --> ", state.defaultValue, " and declared as --> ", col.DefaultValue, ", changed is ", changed)
+	return changed
+}
+
+// normalizeDefault returns the default expression in a form in which the declared DefaultValue and the expression returned by pg_get_expr can be compared: normalized as a constraint definition, and without the parentheses around the whole expression
+func normalizeDefault(expression string, schema string) string {
+	normalized := normalizeConstraintDefinition(expression, schema)
+	for parenthesized(normalized) {
+		normalized = strings.TrimSpace(normalized[1 : len(normalized)-1])
+	}
+	return normalized
+}
+
+// parenthesized returns if the whole expression is enclosed in a single pair of parentheses
+func parenthesized(expression string) bool {
+	if !strings.HasPrefix(expression, "(") {
+		return false
+	}
+	depth := 0
+	for i := 0; i < len(expression); i++ {
+		switch expression[i] {
+		case '\'', '"':
+			i = quotedEnd(expression, i) - 1
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i == len(expression)-1
+			}
+		}
+	}
+	return false
+}
+
+// simplifyExpression removes the casts (::type) that follow the values in the expression, and the whitespace around its operators, outside string literals and quoted identifiers
+func simplifyExpression(expression string) string {
+	var stripped strings.Builder
+	for i := 0; i < len(expression); i++ {
+		switch {
+		case expression[i] == ' ' || expression[i] == '\t' || expression[i] == '\n' || expression[i] == '\r':
+			next := strings.TrimLeft(expression[i:], " \t\n\r")
+			previous := stripped.String()
+			if next == "" || strings.ContainsAny(next[:1], operatorCharacters) || previous != "" && strings.ContainsAny(previous[len(previous)-1:], operatorCharacters) {
+				continue
+			}
+			stripped.WriteByte(' ')
+			i = len(expression) - len(next) - 1
+		case expression[i] == '\'' || expression[i] == '"':
+			end := quotedEnd(expression, i)
+			stripped.WriteString(expression[i:end])
+			i = end - 1
+		case strings.HasPrefix(expression[i:], "::"):
+			i += len(castPattern.FindString(expression[i:])) - 1
+		default:
+			stripped.WriteByte(expression[i])
+		}
+	}
+	return stripped.String()
+}
+
+// planBackfill returns the statement that updates the existing rows with the new default value, as decided by the backfill policy of the column.
+// With a batch size, the update runs after the transaction is committed, in batches keyed by the single column primary key of the table
+func (t *Table) planBackfill(ctx context.Context, col Column) ([]PlannedStatement, error) {
+	if col.Backfill == BackfillNever {
+		return nil, nil
+	}
+	if col.BackfillBatchSize == 0 {
+		statement, err := col.prepareSQLStatement(StepBackfillDefault, t.Name, t.DefaultSchema, true)
+		if err != nil {
+			return nil, &MigrationError{Table: t.Name, Column: col.Name, Step: StepBackfillDefault, Err: err}
+		}
+		return []PlannedStatement{{Table: t.Name, Column: col.Name, Step: StepBackfillDefault, SQL: statement}}, nil
+	}
+	key, err := t.fetchPrimaryKeyColumn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, &MigrationError{Table: t.Name, Column: col.Name, Step: StepBackfillDefault, Err: errors.New("a batched backfill requires the table to have a single column primary key")}
+	}
+	batch := col.batchedBackfill(t.Name, t.DefaultSchema, key)
+	return []PlannedStatement{{Table: t.Name, Column: col.Name, Step: StepBackfillDefault, SQL: batch.next, Concurrent: true, batch: batch}}, nil
+}
+
+// batchedBackfill returns the statements that update a batch of rows, in the order of the primary key. Each of them returns the last primary key of the batch and the number of rows in it
+func (c *Column) batchedBackfill(tableName string, schema string, key string) *batchedUpdate {
+	table := qualifiedName(schema, tableName)
+	column := quoteIdentifier(c.Name)
+	primary := quoteIdentifier(key)
+	condition := "TRUE"
+	if c.Backfill == BackfillNulls {
+		condition = fmt.Sprintf("%s IS NULL", column)
+	}
+	statement := `WITH batch AS (SELECT %[3]s FROM %[1]s WHERE %[5]s%[6]s ORDER BY %[3]s LIMIT %[7]d), updated AS (UPDATE %[1]s AS target SET %[2]s = %[4]s FROM batch WHERE target.%[3]s = batch.%[3]s) SELECT max(%[3]s), count(*) FROM batch`
+	return &batchedUpdate{
+		first: fmt.Sprintf(statement, table, column, primary, c.DefaultValue, condition, "", c.BackfillBatchSize),
+		next:  fmt.Sprintf(statement, table, column, primary, c.DefaultValue, condition, fmt.Sprintf(" AND %s > $1", primary), c.BackfillBatchSize),
+		sleep: c.BackfillSleep,
+	}
+}
+
+// runBatches executes the batched update on DB until a batch updates no rows. Every batch is committed on its own
+func (t *Table) runBatches(ctx context.Context, statement PlannedStatement) error {
+	var last interface{}
+	var total int64
+	for {
+		var maximum interface{}
+		var count int64
+		var err error
+		if last == nil {
+			err = t.DB.QueryRow(ctx, statement.batch.first).Scan(&maximum, &count)
+		} else {
+			err = t.DB.QueryRow(ctx, statement.batch.next, last).Scan(&maximum, &count)
+		}
+		if err != nil {
+			return statementError(statement, err)
+		}
+		if count == 0 {
+			log.Infoln("Backfilled ", total, " rows of column --> ", statement.Column, " in table --> ", t.Name)
+			return nil
+		}
+		total += count
+		last = maximum
+		log.Debugln("Backfilled ", count, " rows of column --> ", statement.Column, " up to key --> ", last)
+		if statement.batch.sleep > 0 {
+			select {
+			case <-ctx.Done():
+				return statementError(statement, ctx.Err())
+			case <-time.After(statement.batch.sleep):
+			}
+		}
+	}
+}
+
+// fetchPrimaryKeyColumn returns the name of the column of the primary key of the table, or an empty string if the table doesn't have a single column primary key
+func (t *Table) fetchPrimaryKeyColumn(ctx context.Context) (string, error) {
+	var name string
+	statement := `
+		SELECT a.attname::text
+		FROM pg_catalog.pg_constraint con
+		JOIN pg_catalog.pg_class c ON c.oid = con.conrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_catalog.pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = con.conkey[1]
+		WHERE n.nspname = $1 AND c.relname = $2 AND con.contype = 'p' AND array_length(con.conkey, 1) = 1
+	`
+	err := t.Tx.QueryRow(ctx, statement, t.DefaultSchema, t.Name).Scan(&name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		log.Warningln("While querying for the primary key of table --> ", t.Name, " error is --> ", err)
+		return "", &MigrationError{Table: t.Name, SQL: statement, Err: err}
+	}
+	return name, nil
+}
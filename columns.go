@@ -4,24 +4,59 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
+)
+
+// Actions that can be set on a column
+const (
+	ActionAdd  = "Add"  // Adds the column, or updates it if it already exists (default)
+	ActionDrop = "Drop" // Drops the column, if it exists
 )
 
 // Column stores all the parameters of each column inside a table
 type Column struct {
-	Name           string
-	Datatype       string
-	PseudoDatatype string // This is the name of the datatype that is used by PostgreSQL to store the mentioned Datatype. Eg.: time --> time without/with time zone, timestamp --> timestamp with/without time zone, etc.
-	Action         string
-	DefaultExists  bool
-	DefaultValue   string
-	IsUnique       bool
-	IsPrimary      bool
-	IsNotNull      bool
-	IndexRequired  bool
+	Name           string `yaml:"name,omitempty"`
+	Datatype       string `yaml:"datatype,omitempty"`
+	PseudoDatatype string `yaml:"pseudo_datatype,omitempty"` // This is the name of the datatype that is used by PostgreSQL to store the mentioned Datatype. Eg.: time --> time without/with time zone, timestamp --> timestamp with/without time zone, etc.
+	Action         string `yaml:"action,omitempty"`
+	DefaultExists  bool   `yaml:"default_exists,omitempty"`
+	DefaultValue   string `yaml:"default_value,omitempty"`
+	IsUnique       bool   `yaml:"is_unique,omitempty"`
+	IsPrimary      bool   `yaml:"is_primary,omitempty"`
+	IsNotNull      bool   `yaml:"is_not_null,omitempty"`
+	// Denotes if NOT NULL is set after the transaction is committed, through a NOT VALID check constraint that is validated without blocking writes
+	SafeNotNull   bool `yaml:"safe_not_null,omitempty"`
+	IndexRequired bool `yaml:"index_required,omitempty"`
 	// Stores the Index Type: GIN, etc. Default will be empty, which is B-Tree (default index type in postgres)
-	IndexType       string
-	Comment         string
-	SequenceRestart int64
+	IndexType string `yaml:"index_type,omitempty"`
+	// Denotes if the index is built with CREATE INDEX CONCURRENTLY, which doesn't block writes. The build runs on Table.DB after the transaction is committed
+	IndexConcurrently bool   `yaml:"index_concurrently,omitempty"`
+	Comment           string `yaml:"comment,omitempty"` // Set on the column with COMMENT ON COLUMN, whenever it differs from the description in the DB
+	// Value that the sequence of a serial or identity column is restarted with, when the column is added. 0 doesn't restart the sequence
+	SequenceRestart int64 `yaml:"sequence_restart,omitempty"`
+	// Denotes if the sequence of an existing column is restarted as well, but only when the next value it would hand out is lower than SequenceRestart, so that it never goes back
+	SequenceRestartIfLower bool  `yaml:"sequence_restart_if_lower,omitempty"`
+	SequenceMin            int64 `yaml:"sequence_min,omitempty"`   // Minimum value of the sequence. 0 leaves it unchanged
+	SequenceMax            int64 `yaml:"sequence_max,omitempty"`   // Maximum value of the sequence. 0 leaves it unchanged
+	SequenceCache          int64 `yaml:"sequence_cache,omitempty"` // Number of values of the sequence that are preallocated by each session. 0 leaves it unchanged
+	SequenceCycle          bool  `yaml:"sequence_cycle,omitempty"` // Denotes if the sequence wraps around once it reaches its maximum value. Applied whenever one of the other options is set
+	// Stores the previous names of the column. If the column doesn't exist, but one of these does, that column is renamed instead of adding a new one
+	RenamedFrom []string `yaml:"renamed_from,omitempty"`
+	// Makes the column an identity column: IdentityAlways or IdentityByDefault. An existing serial column declared as an identity is converted, and continues from the current value of its sequence
+	Identity          string `yaml:"identity,omitempty"`
+	IdentityStart     int64  `yaml:"identity_start,omitempty"`     // Value that the identity starts with. 0 leaves it to PostgreSQL (1). Changing it on an existing identity doesn't change the next value it hands out (see SequenceRestartIfLower)
+	IdentityIncrement int64  `yaml:"identity_increment,omitempty"` // Value that the identity is incremented by. 0 leaves it to PostgreSQL (1)
+	// Denotes if the datatype of the existing column can be changed in a way that rewrites the table, or that can lose or reject data. Only binary-coercible and widening changes are applied otherwise
+	AllowUnsafeTypeChange bool `yaml:"allow_unsafe_type_change,omitempty"`
+	// Expression that converts the existing values when the datatype changes, such as to_timestamp(created_at). Defaults to a cast of the column to Datatype
+	Using string `yaml:"using,omitempty"`
+	// Decides which existing rows are updated when the default value of the column changes: BackfillNever (default), BackfillNulls or BackfillAll
+	Backfill string `yaml:"backfill,omitempty"`
+	// Number of rows updated per batch by the backfill. 0 updates all the rows in a single statement inside the transaction, otherwise the batches run on Table.DB after the transaction is committed
+	BackfillBatchSize int           `yaml:"backfill_batch_size,omitempty"`
+	BackfillSleep     time.Duration `yaml:"backfill_sleep,omitempty"` // Time to wait between the batches of the backfill
+	// Stores the column referenced by this column. The foreign key is named <table>_<column>_fkey, and is re-created only when its definition changes
+	References *ForeignKey `yaml:"references,omitempty"`
 }
 
 // NewColumn initializes the Column with the default parameters
@@ -32,7 +67,7 @@ func NewColumn(c Column) Column {
 	col.Datatype = c.Datatype
 	col.PseudoDatatype = c.PseudoDatatype
 	if c.Action == "" {
-		col.Action = "Add"
+		col.Action = ActionAdd
 	} else {
 		col.Action = c.Action
 	}
@@ -70,71 +105,167 @@ func NewColumn(c Column) Column {
 	if len(c.IndexType) > 0 && c.IndexRequired {
 		col.IndexType = c.IndexType
 	}
+	col.IndexConcurrently = c.IndexConcurrently && c.IndexRequired
 	col.Comment = c.Comment
-	if c.SequenceRestart == 0 {
-		col.SequenceRestart = 1
-	} else {
-		col.SequenceRestart = c.SequenceRestart
-	}
+	col.RenamedFrom = c.RenamedFrom
+	col.References = c.References
+	col.SafeNotNull = c.SafeNotNull && c.IsNotNull
+	col.Identity = c.Identity
+	col.IdentityStart = c.IdentityStart
+	col.IdentityIncrement = c.IdentityIncrement
+	col.AllowUnsafeTypeChange = c.AllowUnsafeTypeChange
+	col.Using = c.Using
+	col.Backfill = c.Backfill
+	col.BackfillBatchSize = c.BackfillBatchSize
+	col.BackfillSleep = c.BackfillSleep
+	col.SequenceRestart = c.SequenceRestart
+	col.SequenceRestartIfLower = c.SequenceRestartIfLower
+	col.SequenceMin = c.SequenceMin
+	col.SequenceMax = c.SequenceMax
+	col.SequenceCache = c.SequenceCache
+	col.SequenceCycle = c.SequenceCycle
 	return col
 }
 
+// uniqueConstraintName returns the name of the unique constraint that is added on the column in step 5
+func uniqueConstraintName(tableName string, columnName string) string {
+	return fmt.Sprintf("%s_%s_unique", tableName, columnName)
+}
+
+// primaryKeyName returns the name of the primary key constraint that is added on the column in step 6
+func primaryKeyName(tableName string, columnName string) string {
+	return fmt.Sprintf("%s_%s", tableName, columnName)
+}
+
+// indexMethod returns the access method of the index on the column, which defaults to btree
+func (c *Column) indexMethod() string {
+	if c.IndexType == "" {
+		return "btree"
+	}
+	return strings.ToLower(c.IndexType)
+}
+
+// uniqueConstraint returns the unique constraint that is added on the column in step 5
+func (c *Column) uniqueConstraint(tableName string) Constraint {
+	return Constraint{Name: uniqueConstraintName(tableName, c.Name), Value: fmt.Sprintf("UNIQUE (%s)", quoteIdentifier(c.Name))}
+}
+
+// indexName returns the name of the index that is created on the column in step 8
+func indexName(tableName string, columnName string) string {
+	return fmt.Sprintf("%s_%s_index", tableName, columnName)
+}
+
+// prepareRenameStatements prepares the statements that rename the column from its previous name, along with the index and the unique, primary key and foreign key constraints that are named after the column
+func (c *Column) prepareRenameStatements(from string, tableName string, schema string, uniquePresent bool, primaryPresent bool, foreignKeyPresent bool) []string {
+	table := qualifiedName(schema, tableName)
+	statements := []string{
+		fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", table, quoteIdentifier(from), quoteIdentifier(c.Name)),
+		fmt.Sprintf("ALTER INDEX IF EXISTS %s RENAME TO %s", qualifiedName(schema, indexName(tableName, from)), quoteIdentifier(indexName(tableName, c.Name))),
+	}
+	if uniquePresent {
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s RENAME CONSTRAINT %s TO %s", table, quoteIdentifier(uniqueConstraintName(tableName, from)), quoteIdentifier(uniqueConstraintName(tableName, c.Name))))
+	}
+	if primaryPresent {
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s RENAME CONSTRAINT %s TO %s", table, quoteIdentifier(primaryKeyName(tableName, from)), quoteIdentifier(primaryKeyName(tableName, c.Name))))
+	}
+	if foreignKeyPresent {
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s RENAME CONSTRAINT %s TO %s", table, quoteIdentifier(foreignKeyName(tableName, from)), quoteIdentifier(foreignKeyName(tableName, c.Name))))
+	}
+	return statements
+}
+
 // prepareSQLStatement prepares and returns the statement that needs to be executed by the table
 func (c *Column) prepareSQLStatement(step int, tableName string, schema string, columnPresent bool) (string, error) {
 	log.Debugln("Executing ", c.Name, " with step --> ", step)
 	var statement string
-	if step == 1 {
+	table := qualifiedName(schema, tableName)
+	column := quoteIdentifier(c.Name)
+	if step == StepAddColumn {
 		// This is the step where the column is added without a default value
 		// statement = "ALTER TABLE %s ADD %s %s"%(table_name, self.column_name, self.datatype)
-		statement = fmt.Sprintf("ALTER TABLE %s.%s ADD %s %s", schema, tableName, c.Name, c.Datatype)
-	} else if step == 2 {
+		statement = fmt.Sprintf("ALTER TABLE %s ADD %s %s", table, column, c.Datatype)
+		if c.Identity != "" {
+			statement = fmt.Sprintf("%s %s", statement, c.identityClause())
+		} else if c.DefaultExists {
+			// Since PostgreSQL 11, adding a column with a non-volatile default doesn't rewrite the table
+			statement = fmt.Sprintf("%s DEFAULT %s", statement, c.DefaultValue)
+		}
+	} else if step == StepSetDefault {
 		// This is the step where a default value is set for the column
 		// statement = cursor.mogrify("ALTER TABLE %(table)s ALTER COLUMN %(column)s SET DEFAULT %(value)s", {"table" : AsIs(table_name), "column" : AsIs(self.column_name), "value" : AsIs(self.default_value)})
 		if c.DefaultExists {
-			statement = fmt.Sprintf("ALTER TABLE %s.%s ALTER COLUMN %s SET DEFAULT %s", schema, tableName, c.Name, c.DefaultValue)
+			statement = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET DEFAULT %s", table, column, c.DefaultValue)
 		}
-	} else if step == 3 {
-		// This is the step where the default value is updated for all the existing rows
+	} else if step == StepBackfillDefault {
+		// This is the step where the default value is updated for the existing rows, as per the backfill policy
 		// statement = cursor.mogrify("UPDATE %(table)s SET %(column)s = %(value)s", {"table" : AsIs(table_name), "column" : AsIs(self.column_name), "value" : AsIs(self.default_value)})
-		if c.DefaultExists && !columnPresent {
-			statement = fmt.Sprintf("UPDATE %s.%s SET %s = %s", schema, tableName, c.Name, c.DefaultValue)
+		if c.DefaultExists && columnPresent {
+			if c.Backfill == BackfillAll {
+				statement = fmt.Sprintf("UPDATE %s SET %s = %s", table, column, c.DefaultValue)
+			} else if c.Backfill == BackfillNulls {
+				statement = fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s IS NULL", table, column, c.DefaultValue, column)
+			}
 		}
-	} else if step == 4 {
-		// This is the step where the sequence is altered, in case sequence_restart is > 0 and datatype is either bigserial or serial
+	} else if step == StepRestartSequence {
+		// This is the step where the sequence is restarted, in case sequence_restart is > 0 and the column is backed by a sequence. The sequence of an existing column is only moved forward, if SequenceRestartIfLower is set
 		// statement = cursor.mogrify("ALTER SEQUENCE %(sequence_name)s RESTART WITH %(value)s", {"sequence_name" : AsIs(sequence_name), "value" : self.sequence_restart})
-		if strings.Contains(c.Datatype, "serial") {
-			statement = fmt.Sprintf("ALTER SEQUENCE %s RESTART WITH %d", tableName+"_"+c.Name+"_seq", c.SequenceRestart)
+		if c.SequenceRestart > 0 && c.sequenceBacked() && (!columnPresent || c.SequenceRestartIfLower) {
+			statement = c.sequenceRestart(tableName, schema)
 		}
-	} else if step == 5 {
+	} else if step == StepUnique {
 		// This is the step where a unique constraint is added, in case the column in unique
 		if c.IsUnique {
 			// statement = "ALTER TABLE %s ADD UNIQUE (%s)"%(table_name, self.column_name)
-			constraint := Constraint{Name: fmt.Sprintf("%s_%s_unique", tableName, c.Name), Value: fmt.Sprintf("UNIQUE (%s)", c.Name)}
+			constraint := c.uniqueConstraint(tableName)
 			statement = fmt.Sprintf("%s; %s", constraint.createDropRule(tableName, schema), constraint.createAddRule(tableName, schema))
-			// statement = fmt.Sprintf("ALTER TABLE %s ADD UNIQUE (%s)", tableName, c.Name)
 		}
-	} else if step == 6 {
+	} else if step == StepPrimaryKey {
 		// This is the step where a primary key constraint is added, in case the column is a primary key
 		if c.IsPrimary {
 			// statement = "ALTER TABLE %s ADD CONSTRAINT %s PRIMARY KEY(%s)"%(table_name, table_name + "_" +self.column_name, self.column_name)
-			statement = fmt.Sprintf("ALTER TABLE %s.%s ADD CONSTRAINT %s PRIMARY KEY(%s)", schema, tableName, tableName+"_"+c.Name, c.Name)
+			statement = fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s PRIMARY KEY(%s)", table, quoteIdentifier(primaryKeyName(tableName, c.Name)), column)
 		}
-	} else if step == 7 {
+	} else if step == StepNotNull {
 		// This is the step where NOT NULL is applied to a particular column
 		if c.IsNotNull {
 			// statement = "ALTER TABLE %s ALTER COLUMN %s SET NOT NULL"%(table_name, self.column_name)
-			statement = fmt.Sprintf("ALTER TABLE %s.%s ALTER COLUMN %s SET NOT NULL", schema, tableName, c.Name)
+			statement = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET NOT NULL", table, column)
 		}
-	} else if step == 8 {
+	} else if step == StepIndex {
 		// This is the step where the index is created on this column
 		if c.IndexRequired {
+			index := quoteIdentifier(indexName(tableName, c.Name))
+			create := "CREATE INDEX"
+			if c.IndexConcurrently {
+				create = "CREATE INDEX CONCURRENTLY"
+			}
 			if len(c.IndexType) > 0 {
-				statement = fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_%s_index ON %s.%s USING %s(%s)", tableName, c.Name, schema, tableName, c.IndexType, c.Name)
+				statement = fmt.Sprintf("%s IF NOT EXISTS %s ON %s USING %s(%s)", create, index, table, c.IndexType, column)
 			} else {
-				statement = fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_%s_index ON %s.%s (%s)", tableName, c.Name, schema, tableName, c.Name)
+				statement = fmt.Sprintf("%s IF NOT EXISTS %s ON %s (%s)", create, index, table, column)
 			}
 		}
-	} else if step == 101 {
+	} else if step == StepDropColumn {
+		// This is the step where the column is dropped from the table
+		statement = fmt.Sprintf("ALTER TABLE %s DROP COLUMN IF EXISTS %s", table, column)
+	} else if step == StepComment {
+		// This is the step where the comment is set on the column
+		if c.Comment != "" {
+			statement = fmt.Sprintf("COMMENT ON COLUMN %s.%s IS %s", table, column, quoteLiteral(c.Comment))
+		}
+	} else if step == StepDropUnique {
+		// This is the step where the unique constraint is dropped, since the column is no longer unique
+		statement = Constraint{Name: uniqueConstraintName(tableName, c.Name)}.createDropRule(tableName, schema)
+	} else if step == StepDropPrimaryKey {
+		// This is the step where the primary key constraint is dropped, since the column is no longer the primary key
+		statement = Constraint{Name: primaryKeyName(tableName, c.Name)}.createDropRule(tableName, schema)
+	} else if step == StepDropDefault {
+		// This is the step where the default value is dropped, since the column no longer has one
+		statement = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP DEFAULT", table, column)
+	} else if step == StepDropNotNull {
+		// This is the step where NOT NULL is dropped, since the column is no longer declared NOT NULL
+		statement = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP NOT NULL", table, column)
+	} else if step == StepAlterDatatype {
 		// This is the step where the column's datatype is altered
 		if strings.Contains(c.Datatype, "serial") {
 			errorStatement := fmt.Sprintf("Can't modify datatype to SERIAL versions, while modifying \nTable --> %s \nColumn --> %s \nDatatype --> %s", tableName, c.Name, c.Datatype)
@@ -142,7 +273,11 @@ func (c *Column) prepareSQLStatement(step int, tableName string, schema string,
 			return "", err
 		}
 		// statement = "ALTER TABLE %s ALTER COLUMN %s TYPE %s USING %s::%s"%(table_name, self.column_name, self.datatype, self.column_name, altered_datatype)
-		statement = fmt.Sprintf("ALTER TABLE %s.%s ALTER COLUMN %s TYPE %s USING %s::%s", schema, tableName, c.Name, c.Datatype, c.Name, c.Datatype)
+		if c.Using != "" {
+			statement = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s USING %s", table, column, c.Datatype, c.Using)
+		} else {
+			statement = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s USING %s::%s", table, column, c.Datatype, column, c.Datatype)
+		}
 	}
 
 	log.Debugln("In prepareSQLStatement, statement is \n", statement)
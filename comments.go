@@ -0,0 +1,64 @@
+package schemamagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	pgx "github.com/jackc/pgx/v5"
+)
+
+// planTableComment returns the statement that sets the comment of the table, if it differs from the description in pg_description. Nothing is returned when Comment is empty, so comments set by hand are left alone
+func (t *Table) planTableComment(ctx context.Context, tablePresence bool) ([]PlannedStatement, error) {
+	if t.Comment == "" {
+		return nil, nil
+	}
+	if tablePresence {
+		var description string
+		statement := `
+			SELECT coalesce(obj_description(c.oid, 'pg_class'), '')
+			FROM pg_catalog.pg_class c
+			JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+			WHERE n.nspname = $1 AND c.relname = $2
+		`
+		if err := t.Tx.QueryRow(ctx, statement, t.DefaultSchema, t.Name).Scan(&description); err != nil {
+			log.Warningln("While querying for the comment of table --> ", t.Name, " error is --> ", err)
+			return nil, &MigrationError{Table: t.Name, SQL: statement, Err: err}
+		}
+		if description == t.Comment {
+			return nil, nil
+		}
+	}
+	statement := fmt.Sprintf("COMMENT ON TABLE %s IS %s", qualifiedName(t.DefaultSchema, t.Name), quoteLiteral(t.Comment))
+	return []PlannedStatement{{Table: t.Name, Step: StepTableComment, SQL: statement}}, nil
+}
+
+// planColumnComment returns the statement that sets the comment of the column, if it differs from the description in pg_description. Nothing is returned when Comment is empty, so comments set by hand are left alone
+func (t *Table) planColumnComment(ctx context.Context, col Column, existingName string, columnPresence bool) ([]PlannedStatement, error) {
+	if col.Comment == "" {
+		return nil, nil
+	}
+	if columnPresence {
+		var description string
+		statement := `
+			SELECT coalesce(col_description(c.oid, a.attnum), '')
+			FROM pg_catalog.pg_attribute a
+			JOIN pg_catalog.pg_class c ON c.oid = a.attrelid
+			JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+			WHERE n.nspname = $1 AND c.relname = $2 AND a.attname = $3 AND NOT a.attisdropped
+		`
+		err := t.Tx.QueryRow(ctx, statement, t.DefaultSchema, t.Name, existingName).Scan(&description)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			log.Warningln("While querying for the comment of column --> ", existingName, " in table --> ", t.Name, " error is --> ", err)
+			return nil, &MigrationError{Table: t.Name, Column: col.Name, SQL: statement, Err: err}
+		}
+		if description == col.Comment {
+			return nil, nil
+		}
+	}
+	statement, err := col.prepareSQLStatement(StepComment, t.Name, t.DefaultSchema, columnPresence)
+	if err != nil {
+		return nil, &MigrationError{Table: t.Name, Column: col.Name, Step: StepComment, Err: err}
+	}
+	return []PlannedStatement{{Table: t.Name, Column: col.Name, Step: StepComment, SQL: statement}}, nil
+}
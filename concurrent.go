@@ -0,0 +1,71 @@
+package schemamagic
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	pgx "github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ErrNoDB is returned (wrapped in a *MigrationError) when statements need to run outside the transaction, but DB is not set
+var ErrNoDB = errors.New("DB is not set, which is required to run statements outside the transaction")
+
+// executor executes a statement on either a transaction or a pool
+type executor interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+}
+
+// queryer runs a single row query on either a transaction or a pool
+type queryer interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// RunConcurrent executes the statements of the last Begin that can't run inside a transaction (such as CREATE INDEX CONCURRENTLY and batched backfills), one at a time on DB. It needs to be called after the transaction has been committed, which Begin does by itself when Autocommit is set.
+// If a concurrent index build fails, the INVALID index that it leaves behind is dropped before the error is returned, so that the next run builds it again
+func (t *Table) RunConcurrent(ctx context.Context) error {
+	pending := t.concurrent
+	t.concurrent = nil
+	if len(pending) == 0 {
+		return nil
+	}
+	if t.DB == nil {
+		return statementError(pending[0], ErrNoDB)
+	}
+	definitionHash := t.definitionHash()
+	for _, statement := range pending {
+		log.Infoln("Executing outside the transaction on table --> ", t.Name, " statement --> ", statement.SQL)
+		started := time.Now()
+		if statement.batch != nil {
+			if err := t.runBatches(ctx, statement); err != nil {
+				return err
+			}
+		} else if _, err := t.DB.Exec(ctx, statement.SQL); err != nil {
+			log.Warningln("Statement --> ", statement.SQL, " could not be executed because of error --> ", err)
+			if statement.Index != "" {
+				t.dropInvalidIndex(ctx, statement.Index)
+			}
+			return statementError(statement, err)
+		}
+		if t.RecordHistory {
+			if err := t.recordHistory(ctx, t.DB, statement, time.Since(started), definitionHash); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dropInvalidIndex drops the index if it has been left INVALID by a failed concurrent build. Failures are only logged, since the build error is the one returned
+func (t *Table) dropInvalidIndex(ctx context.Context, name string) {
+	current, presence, err := t.fetchIndex(ctx, t.DB, name)
+	if err != nil || !presence || current.valid {
+		return
+	}
+	statement := dropIndexStatement(t.DefaultSchema, name, true)
+	log.Infoln("Dropping the invalid index left behind by the failed build --> ", statement)
+	if _, err := t.DB.Exec(ctx, statement); err != nil {
+		log.Warningln("Couldn't drop the invalid index --> ", name, " error is --> ", err)
+	}
+}
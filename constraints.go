@@ -1,21 +1,222 @@
 package schemamagic
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"regexp"
+	"strings"
+
+	pgx "github.com/jackc/pgx/v5"
+)
+
+var (
+	// whitespacePattern matches runs of whitespace in a constraint definition
+	whitespacePattern = regexp.MustCompile(`\s+`)
+	// punctuationSpacePattern matches the whitespace around parentheses and commas in a constraint definition
+	punctuationSpacePattern = regexp.MustCompile(`\s*([(),])\s*`)
+	// noActionPattern matches the default referential actions, which are left out by pg_get_constraintdef
+	noActionPattern = regexp.MustCompile(`\s*on (delete|update) no action`)
+	// lowerIdentifierPattern matches the identifiers that PostgreSQL doesn't quote
+	lowerIdentifierPattern = regexp.MustCompile(`^[a-z_][a-z0-9_$]*$`)
+	// qualifierPattern matches an unquoted name followed by a dot, which qualifies the name after it, in a lower case definition
+	qualifierPattern = regexp.MustCompile(`(^|[^a-z0-9_$.\x00])([a-z_][a-z0-9_$]*)\.`)
+	// atomPattern matches a single name, number or placeholder of a literal in a normalized definition
+	atomPattern = regexp.MustCompile(`^-?[a-z0-9_$.\x00]+$`)
+	// numericLiteralPattern matches a quoted literal that holds a number
+	numericLiteralPattern = regexp.MustCompile(`^'-?[0-9]+(?:\.[0-9]+)?'$`)
 )
 
 // Constraint stores the applicable constraint on a table
 type Constraint struct {
-	Name  string // This stores the name of the constrant
-	Value string // This stores the constrant that needs to be applied
+	Name  string `yaml:"name"`  // This stores the name of the constrant
+	Value string `yaml:"value"` // This stores the constrant that needs to be applied
 }
 
 // createDropRule generates the SQL statement that will be used to drop this constraint
 func (c Constraint) createDropRule(tableName string, schema string) string {
-	return fmt.Sprintf("ALTER TABLE %s.%s DROP CONSTRAINT IF EXISTS %s", schema, tableName, c.Name)
+	return fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s", qualifiedName(schema, tableName), quoteIdentifier(c.Name))
 }
 
 // createAddRule generates the SQL statement that will be used to add this constraint
 func (c Constraint) createAddRule(tableName string, schema string) string {
-	return fmt.Sprintf("ALTER TABLE %s.%s ADD CONSTRAINT %s %s", schema, tableName, c.Name, c.Value)
+	return fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s %s", qualifiedName(schema, tableName), quoteIdentifier(c.Name), c.Value)
+}
+
+// validate checks that the constraint can be turned into valid SQL statements
+func (c Constraint) validate() error {
+	if c.Name == "" {
+		return errors.New("constraint name is empty")
+	}
+	if c.Value == "" {
+		return fmt.Errorf("constraint %s has an empty value", c.Name)
+	}
+	return nil
+}
+
+// normalizeConstraintDefinition returns the definition in a form in which the declared Value and the definition returned by pg_get_constraintdef can be compared: lower case, without casts (through simplifyExpression), without the schema of the table, without redundant whitespace and parentheses, with numeric literals unquoted, and without the default referential actions.
+// String literals and quoted identifiers are kept as they are (so that they are compared case sensitively), except for quoted identifiers that PostgreSQL wouldn't need to quote, which are unquoted
+func normalizeConstraintDefinition(definition string, schema string) string {
+	definition = simplifyExpression(definition)
+	var normalized strings.Builder
+	// kept stores the literals and quoted identifiers, which are replaced with placeholders while the rest of the definition is normalized
+	var kept []string
+	for i := 0; i < len(definition); i++ {
+		switch definition[i] {
+		case '\'', '"':
+			end := quotedEnd(definition, i)
+			quoted := definition[i:end]
+			if definition[i] == '"' && len(quoted) > 1 {
+				name := strings.ReplaceAll(quoted[1:len(quoted)-1], `""`, `"`)
+				if name == schema && strings.HasPrefix(definition[end:], ".") {
+					// The schema of the table is left out by pg_get_constraintdef
+					i = end
+					continue
+				}
+				if lowerIdentifierPattern.MatchString(name) {
+					normalized.WriteString(name)
+					i = end - 1
+					continue
+				}
+			}
+			if definition[i] == '\'' && numericLiteralPattern.MatchString(quoted) {
+				// PostgreSQL prints negative numbers as quoted literals with a cast ('-1'::integer)
+				normalized.WriteString(quoted[1 : len(quoted)-1])
+				i = end - 1
+				continue
+			}
+			fmt.Fprintf(&normalized, "\x00%d\x00", len(kept))
+			kept = append(kept, quoted)
+			i = end - 1
+		default:
+			normalized.WriteString(strings.ToLower(definition[i : i+1]))
+		}
+	}
+	result := whitespacePattern.ReplaceAllString(normalized.String(), " ")
+	result = qualifierPattern.ReplaceAllStringFunc(result, func(match string) string {
+		// The schema of the table is left out by pg_get_constraintdef
+		if parts := qualifierPattern.FindStringSubmatch(match); parts[2] == schema {
+			return parts[1]
+		}
+		return match
+	})
+	result = noActionPattern.ReplaceAllString(result, "")
+	result = strings.TrimSpace(punctuationSpacePattern.ReplaceAllString(result, "$1"))
+	result = stripRedundantParentheses(result)
+	for i, quoted := range kept {
+		result = strings.Replace(result, fmt.Sprintf("\x00%d\x00", i), quoted, 1)
+	}
+	return result
+}
+
+// stripRedundantParentheses removes the pairs of parentheses that directly enclose another pair, such as the ones that pg_get_constraintdef adds around a CHECK expression (CHECK ((a > 0))), and the ones around a single value, until there are none left.
+// Pairs whose inner pair holds a list (((a, b))) are kept, since they aren't redundant. The definition must not contain literals or quoted identifiers
+func stripRedundantParentheses(definition string) string {
+	for {
+		stripped := stripParenthesesOnce(definition)
+		if stripped == definition {
+			return definition
+		}
+		definition = stripped
+	}
+}
+
+// stripParenthesesOnce removes the redundant pairs of parentheses (as described in stripRedundantParentheses) that aren't directly enclosed by another pair. The definition is returned as it is if its parentheses aren't balanced
+func stripParenthesesOnce(definition string) string {
+	closing := make(map[int]int)
+	list := make(map[int]bool)
+	var open []int
+	for i := 0; i < len(definition); i++ {
+		switch definition[i] {
+		case '(':
+			open = append(open, i)
+		case ')':
+			if len(open) == 0 {
+				return definition
+			}
+			closing[open[len(open)-1]] = i
+			open = open[:len(open)-1]
+		case ',':
+			if len(open) > 0 {
+				list[open[len(open)-1]] = true
+			}
+		}
+	}
+	if len(open) > 0 {
+		return definition
+	}
+	removed := make(map[int]bool)
+	for start, end := range closing {
+		if outer, ok := closing[start-1]; ok && outer == end+1 {
+			// The enclosing pair is removed first
+			continue
+		}
+		inner, ok := closing[start+1]
+		doubled := ok && inner == end-1 && !list[start+1]
+		// A single value in parentheses, which PostgreSQL adds around the casted values ((0)::numeric), unless they are the arguments of a function
+		single := atomPattern.MatchString(definition[start+1:end]) && (start == 0 || !identifierCharacter(definition[start-1]))
+		if doubled || single {
+			removed[start], removed[end] = true, true
+		}
+	}
+	var stripped strings.Builder
+	for i := 0; i < len(definition); i++ {
+		if !removed[i] {
+			stripped.WriteByte(definition[i])
+		}
+	}
+	return stripped.String()
+}
+
+// identifierCharacter returns if the character can be part of an unquoted identifier
+func identifierCharacter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '$'
+}
+
+// quotedEnd returns the index just past the quote that closes the literal or quoted identifier starting at start, where doubled quotes are part of the text. The length of the definition is returned if it isn't closed
+func quotedEnd(definition string, start int) int {
+	quote := definition[start]
+	for i := start + 1; i < len(definition); i++ {
+		if definition[i] != quote {
+			continue
+		}
+		if i+1 < len(definition) && definition[i+1] == quote {
+			i++
+			continue
+		}
+		return i + 1
+	}
+	return len(definition)
+}
+
+// fetchConstraintDefinition returns the definition of the constraint on the table, as returned by pg_get_constraintdef, and if the constraint exists
+func (t *Table) fetchConstraintDefinition(ctx context.Context, constraintName string) (string, bool, error) {
+	var definition string
+	statement := `
+		SELECT pg_get_constraintdef(con.oid)
+		FROM pg_catalog.pg_constraint con
+		JOIN pg_catalog.pg_class c ON c.oid = con.conrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1 AND c.relname = $2 AND con.conname = $3
+	`
+	err := t.Tx.QueryRow(ctx, statement, t.DefaultSchema, t.Name, constraintName).Scan(&definition)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		log.Warningln("While querying for the definition of constraint --> ", constraintName, " in table --> ", t.Name, " error is --> ", err)
+		return "", false, &MigrationError{Table: t.Name, Constraint: constraintName, SQL: statement, Err: err}
+	}
+	return definition, true, nil
+}
+
+// checkConstraintDefinition returns if the constraint exists on the table, and if its definition in the DB matches the declared Value
+func (t *Table) checkConstraintDefinition(ctx context.Context, constraint Constraint) (bool, bool, error) {
+	definition, presence, err := t.fetchConstraintDefinition(ctx, constraint.Name)
+	if err != nil || !presence {
+		return presence, false, err
+	}
+	match := normalizeConstraintDefinition(definition, t.DefaultSchema) == normalizeConstraintDefinition(constraint.Value, t.DefaultSchema)
+	log.Debugln("Constraint --> ", constraint.Name, " is defined as --> ", definition, " and declared as --> ", constraint.Value, ", match is ", match)
+	return presence, match, nil
 }
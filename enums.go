@@ -0,0 +1,270 @@
+package schemamagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	pgx "github.com/jackc/pgx/v5"
+)
+
+// Enum is an enum type, added through Table.AddEnum, that is created before the table (and, in a Schema, before every table whose columns use it as their Datatype). Labels that are added to Values are added to the existing type in their declared position, while removing or reordering labels is refused with an *EnumChangeError
+type Enum struct {
+	Name   string   `yaml:"name"`             // Name of the type
+	Schema string   `yaml:"schema,omitempty"` // Schema of the type. Defaults to the DefaultSchema of the table
+	Values []string `yaml:"values"`           // Labels of the type, in order
+}
+
+// EnumChangeError is returned (wrapped in a *MigrationError) when the labels of an existing enum have been removed or reordered in the declaration, which can't be applied without recreating the type and rewriting the columns that use it
+type EnumChangeError struct {
+	Enum      string   // Name of the type
+	Existing  []string // Labels of the type in the DB, in order
+	Declared  []string // Declared labels, in order
+	Removed   []string // Labels of the type in the DB that are no longer declared
+	Reordered bool     // Denotes if the labels of the type in the DB are declared in a different order
+}
+
+// Error returns the description of the refused change
+func (e *EnumChangeError) Error() string {
+	var changes []string
+	if len(e.Removed) > 0 {
+		changes = append(changes, fmt.Sprintf("removes the labels %s", strings.Join(e.Removed, ", ")))
+	}
+	if e.Reordered {
+		changes = append(changes, fmt.Sprintf("reorders the labels %s as %s", strings.Join(e.Existing, ", "), strings.Join(e.Declared, ", ")))
+	}
+	return fmt.Sprintf("the declaration of enum %s %s, which isn't safe since the type would need to be recreated", e.Enum, strings.Join(changes, " and "))
+}
+
+// ErrNewEnumLabel is returned (wrapped in a *MigrationError) when a label that is added to an existing enum is used by a statement in the same transaction, such as a default, a backfill, a constraint or an index, which PostgreSQL refuses until the transaction that added the label has been committed
+var ErrNewEnumLabel = errors.New("the label is added to the enum in the same transaction, and can't be used until the transaction has been committed")
+
+// addedLabel is a label that a planned statement adds to an existing enum
+type addedLabel struct {
+	key   string // Schema qualified key of the enum
+	enum  string // Name of the enum
+	label string // The added label
+}
+
+// AddEnum accepts an enum and appends it to the list of enum types that need to be created before the table
+func (t *Table) AddEnum(enum Enum) {
+	t.enums = append(t.enums, enum)
+}
+
+// schema returns the schema of the enum, which defaults to the schema of the table
+func (e *Enum) schema(defaultSchema string) string {
+	if e.Schema == "" {
+		return defaultSchema
+	}
+	return e.Schema
+}
+
+// validate checks that the enum can be created with the declared labels
+func (e *Enum) validate() error {
+	if err := validateIdentifier("enum", e.Name); err != nil {
+		return err
+	}
+	if e.Schema != "" {
+		if err := validateIdentifier("enum schema", e.Schema); err != nil {
+			return err
+		}
+	}
+	for i, label := range e.Values {
+		// Labels are limited to the same length as identifiers
+		if label == "" || len(label) > maxIdentifierLength {
+			return fmt.Errorf("enum %s has an invalid label %q", e.Name, label)
+		}
+		if slices.Contains(e.Values[:i], label) {
+			return fmt.Errorf("enum %s has the label %q more than once", e.Name, label)
+		}
+	}
+	return nil
+}
+
+// createStatement returns the statement that creates the enum with all its labels
+func (e *Enum) createStatement(defaultSchema string) string {
+	labels := make([]string, 0, len(e.Values))
+	for _, label := range e.Values {
+		labels = append(labels, quoteLiteral(label))
+	}
+	return fmt.Sprintf("CREATE TYPE %s AS ENUM (%s)", qualifiedName(e.schema(defaultSchema), e.Name), strings.Join(labels, ", "))
+}
+
+// addValueStatements compares the existing labels with the declared ones, and returns the statements that add the missing labels, each placed after the label declared before it (or before the first existing label).
+// An *EnumChangeError is returned if any existing label has been removed from the declaration, or is declared in a different order
+func (e *Enum) addValueStatements(defaultSchema string, existing []string) ([]string, error) {
+	var removed []string
+	for _, label := range existing {
+		if !slices.Contains(e.Values, label) {
+			removed = append(removed, label)
+		}
+	}
+	var kept []string
+	for _, label := range e.Values {
+		if slices.Contains(existing, label) {
+			kept = append(kept, label)
+		}
+	}
+	// The labels that are still declared need to keep their order, whether or not others have been removed
+	var remaining []string
+	for _, label := range existing {
+		if slices.Contains(e.Values, label) {
+			remaining = append(remaining, label)
+		}
+	}
+	reordered := !slices.Equal(remaining, kept)
+	if len(removed) > 0 || reordered {
+		return nil, &EnumChangeError{Enum: e.Name, Existing: existing, Declared: e.Values, Removed: removed, Reordered: reordered}
+	}
+	name := qualifiedName(e.schema(defaultSchema), e.Name)
+	current := slices.Clone(existing)
+	var statements []string
+	for i, label := range e.Values {
+		if slices.Contains(current, label) {
+			continue
+		}
+		statement := fmt.Sprintf("ALTER TYPE %s ADD VALUE IF NOT EXISTS %s", name, quoteLiteral(label))
+		if i > 0 {
+			statement = fmt.Sprintf("%s AFTER %s", statement, quoteLiteral(e.Values[i-1]))
+			current = slices.Insert(current, slices.Index(current, e.Values[i-1])+1, label)
+		} else if len(current) > 0 {
+			statement = fmt.Sprintf("%s BEFORE %s", statement, quoteLiteral(current[0]))
+			current = slices.Insert(current, 0, label)
+		} else {
+			current = append(current, label)
+		}
+		statements = append(statements, statement)
+	}
+	return statements, nil
+}
+
+// fetchEnumLabels reads the labels of the enum from pg_enum, in order. false is returned if the type doesn't exist, and an error if it exists but isn't an enum
+func (t *Table) fetchEnumLabels(ctx context.Context, schema string, name string) ([]string, bool, error) {
+	var kind string
+	query := `
+		SELECT t.typtype::text
+			FROM pg_catalog.pg_type t
+			JOIN pg_catalog.pg_namespace n ON n.oid = t.typnamespace
+			WHERE n.nspname = $1 AND t.typname = $2
+	`
+	err := t.Tx.QueryRow(ctx, query, schema, name).Scan(&kind)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		log.Warningln("While querying for type --> ", name, " error is --> ", err)
+		return nil, false, &MigrationError{Table: t.Name, Enum: name, SQL: query, Err: err}
+	}
+	if kind != "e" {
+		return nil, false, &MigrationError{Table: t.Name, Enum: name, Err: fmt.Errorf("type %s already exists and is not an enum", qualifiedName(schema, name))}
+	}
+	query = `
+		SELECT e.enumlabel
+			FROM pg_catalog.pg_enum e
+			JOIN pg_catalog.pg_type t ON t.oid = e.enumtypid
+			JOIN pg_catalog.pg_namespace n ON n.oid = t.typnamespace
+			WHERE n.nspname = $1 AND t.typname = $2
+			ORDER BY e.enumsortorder
+	`
+	rows, err := t.Tx.Query(ctx, query, schema, name)
+	if err != nil {
+		log.Warningln("While querying for the labels of enum --> ", name, " error is --> ", err)
+		return nil, false, &MigrationError{Table: t.Name, Enum: name, SQL: query, Err: err}
+	}
+	labels, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, false, &MigrationError{Table: t.Name, Enum: name, SQL: query, Err: err}
+	}
+	return labels, true, nil
+}
+
+// planEnums returns the statements that create the enums declared with AddEnum, or add the labels that are missing. They are planned before the table is created, since its columns can use them
+func (t *Table) planEnums(ctx context.Context) ([]PlannedStatement, error) {
+	var plan []PlannedStatement
+	for _, enum := range t.enums {
+		schema := enum.schema(t.DefaultSchema)
+		existing, presence, err := t.fetchEnumLabels(ctx, schema, enum.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !presence {
+			log.Debugln("Enum --> ", enum.Name, " does not exist")
+			if schema != t.DefaultSchema {
+				plan = append(plan, PlannedStatement{Table: t.Name, Step: StepCreateSchema, SQL: fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", quoteIdentifier(schema))})
+			}
+			plan = append(plan, PlannedStatement{Table: t.Name, Enum: enum.Name, Step: StepCreateEnum, SQL: enum.createStatement(t.DefaultSchema)})
+			continue
+		}
+		statements, err := enum.addValueStatements(t.DefaultSchema, existing)
+		if err != nil {
+			return nil, &MigrationError{Table: t.Name, Enum: enum.Name, Step: StepAddEnumValue, Err: err}
+		}
+		// The statements add the missing labels in their declared order
+		var labels []string
+		for _, label := range enum.Values {
+			if !slices.Contains(existing, label) {
+				labels = append(labels, label)
+			}
+		}
+		for i, statement := range statements {
+			added := &addedLabel{key: tableKey(schema, enum.Name), enum: enum.Name, label: labels[i]}
+			plan = append(plan, PlannedStatement{Table: t.Name, Enum: enum.Name, Step: StepAddEnumValue, SQL: statement, added: added})
+		}
+	}
+	return plan, nil
+}
+
+// addedLabels returns the labels that the plan adds to existing enums
+func addedLabels(plan []PlannedStatement) []addedLabel {
+	var added []addedLabel
+	for _, statement := range plan {
+		if statement.added != nil {
+			added = append(added, *statement.added)
+		}
+	}
+	return added
+}
+
+// checkAddedLabels returns an error wrapping ErrNewEnumLabel if a statement of the plan that runs inside the transaction uses one of the added labels. A column statement uses a label if the column has the type of the enum and the label appears as a literal in the statement, while constraint and index statements use it if any column of the table has the type of the enum
+func (t *Table) checkAddedLabels(plan []PlannedStatement, added []addedLabel) error {
+	if len(added) == 0 {
+		return nil
+	}
+	// typed stores the keys of the types used by the columns of the table, and the columns that use each of them
+	typed := make(map[string][]string)
+	for _, col := range t.Columns {
+		if key, ok := enumReference(col.Datatype, t.DefaultSchema); ok {
+			typed[key] = append(typed[key], col.Name)
+		}
+	}
+	for _, statement := range plan {
+		if statement.Concurrent || statement.Step == StepCreateEnum || statement.Step == StepAddEnumValue {
+			continue
+		}
+		for _, a := range added {
+			columns, ok := typed[a.key]
+			if !ok || statement.Column != "" && !slices.Contains(columns, statement.Column) {
+				continue
+			}
+			if strings.Contains(statement.SQL, quoteLiteral(a.label)) {
+				log.Warningln("Statement --> ", statement.SQL, " uses the label --> ", a.label, " that is added to enum --> ", a.enum, " in the same transaction")
+				err := statementError(statement, fmt.Errorf("label %s: %w", quoteLiteral(a.label), ErrNewEnumLabel))
+				err.Enum = a.enum
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// enumReference returns the schema qualified key of the type used by the datatype of a column, with any array brackets removed. Quoted names are used as they are, unquoted names are folded to lower case, and unqualified types are assumed to be in defaultSchema.
+// false is returned if the datatype isn't a plain (optionally qualified) type name
+func enumReference(datatype string, defaultSchema string) (string, bool) {
+	name := strings.TrimSpace(datatype)
+	for strings.HasSuffix(name, "[]") {
+		name = strings.TrimSpace(strings.TrimSuffix(name, "[]"))
+	}
+	return qualifiedKey(name, defaultSchema)
+}
@@ -0,0 +1,59 @@
+package schemamagic
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MigrationError is returned when a table could not be introspected or migrated. It records where the failure happened, along with the underlying pgx/pgconn error
+type MigrationError struct {
+	Table      string // Name of the table that was being migrated
+	Column     string // Name of the column that was being migrated, if any
+	Constraint string // Name of the constraint that was being applied, if any
+	Index      string // Name of the index that was being built, if any
+	Enum       string // Name of the enum that was being applied, if any
+	Step       int    // Step that failed (one of the Step constants). 0 means that the failure happened while introspecting the database
+	SQL        string // The statement that failed, if any
+	Err        error  // The underlying error
+}
+
+// Error returns the description of the failure
+func (e *MigrationError) Error() string {
+	var parts []string
+	if e.Table != "" {
+		parts = append(parts, fmt.Sprintf("table %s", e.Table))
+	}
+	if e.Column != "" {
+		parts = append(parts, fmt.Sprintf("column %s", e.Column))
+	}
+	if e.Constraint != "" {
+		parts = append(parts, fmt.Sprintf("constraint %s", e.Constraint))
+	}
+	if e.Index != "" {
+		parts = append(parts, fmt.Sprintf("index %s", e.Index))
+	}
+	if e.Enum != "" {
+		parts = append(parts, fmt.Sprintf("enum %s", e.Enum))
+	}
+	if e.Step != 0 {
+		parts = append(parts, fmt.Sprintf("step %d", e.Step))
+	}
+	message := fmt.Sprintf("schemamagic: %v", e.Err)
+	if len(parts) > 0 {
+		message = fmt.Sprintf("schemamagic: %s: %v", strings.Join(parts, ", "), e.Err)
+	}
+	if e.SQL != "" {
+		message = fmt.Sprintf("%s\nstatement: %s", message, e.SQL)
+	}
+	return message
+}
+
+// Unwrap returns the underlying error, so that errors.Is and errors.As can be used on a MigrationError
+func (e *MigrationError) Unwrap() error {
+	return e.Err
+}
+
+// statementError wraps err with the details of the planned statement that failed
+func statementError(statement PlannedStatement, err error) *MigrationError {
+	return &MigrationError{Table: statement.Table, Column: statement.Column, Constraint: statement.Constraint, Index: statement.Index, Enum: statement.Enum, Step: statement.Step, SQL: statement.SQL, Err: err}
+}
@@ -56,8 +56,11 @@ func main() {
 
 	// table.DropTable()
 	// log.Infoln("Dropping table here...")
-	table.Begin(ctx)
 	log.Infoln("Starting table creation here...")
+	if err := table.Begin(ctx); err != nil {
+		tx.Rollback(ctx)
+		log.Fatalln("Couldn't update table --> error is ", err)
+	}
 
 	commitErr := tx.Commit(ctx)
 	if commitErr != nil {
@@ -0,0 +1,179 @@
+package schemamagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	pgx "github.com/jackc/pgx/v5"
+)
+
+// Referential actions that can be set in ForeignKey.OnDelete and ForeignKey.OnUpdate
+const (
+	NoAction   = "NO ACTION" // Default
+	Restrict   = "RESTRICT"
+	Cascade    = "CASCADE"
+	SetNull    = "SET NULL"
+	SetDefault = "SET DEFAULT"
+)
+
+// referentialActions maps the codes stored in pg_constraint.confdeltype/confupdtype to the referential actions
+var referentialActions = map[string]string{
+	"a": NoAction,
+	"r": Restrict,
+	"c": Cascade,
+	"n": SetNull,
+	"d": SetDefault,
+}
+
+// ForeignKey declares the column referenced by a column. The foreign key constraint is named <table>_<column>_fkey
+type ForeignKey struct {
+	Schema            string `yaml:"schema,omitempty"`             // Schema of the referenced table. Defaults to the DefaultSchema of the table
+	Table             string `yaml:"table"`                        // Name of the referenced table
+	Column            string `yaml:"column"`                       // Name of the referenced column
+	OnDelete          string `yaml:"on_delete,omitempty"`          // One of NoAction (default), Restrict, Cascade, SetNull or SetDefault
+	OnUpdate          string `yaml:"on_update,omitempty"`          // One of NoAction (default), Restrict, Cascade, SetNull or SetDefault
+	Deferrable        bool   `yaml:"deferrable,omitempty"`         // Denotes if the constraint check can be deferred to the end of the transaction
+	InitiallyDeferred bool   `yaml:"initially_deferred,omitempty"` // Denotes if the constraint check is deferred by default (requires Deferrable)
+}
+
+// foreignKeyName returns the name of the foreign key constraint that is added on the column
+func foreignKeyName(tableName string, columnName string) string {
+	return fmt.Sprintf("%s_%s_fkey", tableName, columnName)
+}
+
+// referentialAction returns the normalized referential action, where empty means NO ACTION
+func referentialAction(action string) string {
+	action = strings.ToUpper(strings.Join(strings.Fields(action), " "))
+	if action == "" {
+		return NoAction
+	}
+	return action
+}
+
+// validate checks that the foreign key can be turned into a valid constraint
+func (f *ForeignKey) validate() error {
+	if err := validateIdentifier("referenced table", f.Table); err != nil {
+		return err
+	}
+	if err := validateIdentifier("referenced column", f.Column); err != nil {
+		return err
+	}
+	for _, action := range []string{f.OnDelete, f.OnUpdate} {
+		switch referentialAction(action) {
+		case NoAction, Restrict, Cascade, SetNull, SetDefault:
+		default:
+			return fmt.Errorf("invalid referential action %q", action)
+		}
+	}
+	if f.InitiallyDeferred && !f.Deferrable {
+		return errors.New("a foreign key can be initially deferred only if it is deferrable")
+	}
+	return nil
+}
+
+// referencedSchema returns the schema of the referenced table
+func (f *ForeignKey) referencedSchema(defaultSchema string) string {
+	if f.Schema != "" {
+		return f.Schema
+	}
+	return defaultSchema
+}
+
+// constraint returns the foreign key as a constraint on the column
+func (f *ForeignKey) constraint(tableName string, schema string, columnName string) Constraint {
+	value := fmt.Sprintf("FOREIGN KEY (%s) REFERENCES %s (%s) ON DELETE %s ON UPDATE %s", quoteIdentifier(columnName), qualifiedName(f.referencedSchema(schema), f.Table), quoteIdentifier(f.Column), referentialAction(f.OnDelete), referentialAction(f.OnUpdate))
+	if f.Deferrable {
+		value += " DEFERRABLE"
+		if f.InitiallyDeferred {
+			value += " INITIALLY DEFERRED"
+		}
+	}
+	return Constraint{Name: foreignKeyName(tableName, columnName), Value: value}
+}
+
+// planForeignKey compares the foreign key declared on the column with the one in pg_constraint, and returns the statements that add it, or drop and re-add it, only if its definition has changed.
+// A foreign key that is no longer declared on the column is dropped
+func (t *Table) planForeignKey(ctx context.Context, col Column) ([]PlannedStatement, error) {
+	name := foreignKeyName(t.Name, col.Name)
+	existingName, err := t.foreignKeyExistingName(ctx, col)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := t.fetchForeignKey(ctx, existingName)
+	if err != nil {
+		return nil, err
+	}
+	if col.References == nil {
+		if existing == nil {
+			return nil, nil
+		}
+		log.Debugln("Foreign key --> ", name, " is no longer declared and will be dropped")
+		return []PlannedStatement{{Table: t.Name, Column: col.Name, Constraint: name, Step: StepForeignKey, SQL: Constraint{Name: name}.createDropRule(t.Name, t.DefaultSchema)}}, nil
+	}
+	if err := col.References.validate(); err != nil {
+		return nil, &MigrationError{Table: t.Name, Column: col.Name, Constraint: name, Step: StepForeignKey, Err: err}
+	}
+	declared := *col.References
+	declared.Schema = declared.referencedSchema(t.DefaultSchema)
+	declared.OnDelete = referentialAction(declared.OnDelete)
+	declared.OnUpdate = referentialAction(declared.OnUpdate)
+	declared.InitiallyDeferred = declared.Deferrable && declared.InitiallyDeferred
+	if existing != nil && *existing == declared {
+		log.Debugln("Foreign key --> ", name, " is unchanged")
+		return nil, nil
+	}
+	constraint := col.References.constraint(t.Name, t.DefaultSchema, col.Name)
+	var plan []PlannedStatement
+	if existing != nil {
+		log.Debugln("Foreign key --> ", name, " has changed from ", *existing, " to ", declared)
+		plan = append(plan, PlannedStatement{Table: t.Name, Column: col.Name, Constraint: name, Step: StepForeignKey, SQL: constraint.createDropRule(t.Name, t.DefaultSchema)})
+	}
+	plan = append(plan, PlannedStatement{Table: t.Name, Column: col.Name, Constraint: name, Step: StepForeignKey, SQL: constraint.createAddRule(t.Name, t.DefaultSchema)})
+	return plan, nil
+}
+
+// foreignKeyExistingName returns the name under which the foreign key of the column currently exists. When the column is yet to be renamed by the plan, the foreign key is renamed along with it (before it's compared), so it's read under the previous name
+func (t *Table) foreignKeyExistingName(ctx context.Context, col Column) (string, error) {
+	name := foreignKeyName(t.Name, col.Name)
+	if len(col.RenamedFrom) == 0 {
+		return name, nil
+	}
+	presence, err := t.checkColumnPresence(ctx, col.Name)
+	if err != nil || presence {
+		return name, err
+	}
+	from, err := t.findPreviousName(ctx, col)
+	if err != nil || from == "" {
+		return name, err
+	}
+	return foreignKeyName(t.Name, from), nil
+}
+
+// fetchForeignKey reads the single column foreign key with the name from pg_constraint. It returns nil if there's no such foreign key
+func (t *Table) fetchForeignKey(ctx context.Context, name string) (*ForeignKey, error) {
+	statement := `
+		SELECT rn.nspname, rc.relname, ra.attname, con.confdeltype::text, con.confupdtype::text, con.condeferrable, con.condeferred
+		FROM pg_catalog.pg_constraint con
+		JOIN pg_catalog.pg_class c ON c.oid = con.conrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_catalog.pg_class rc ON rc.oid = con.confrelid
+		JOIN pg_catalog.pg_namespace rn ON rn.oid = rc.relnamespace
+		JOIN pg_catalog.pg_attribute ra ON ra.attrelid = con.confrelid AND ra.attnum = con.confkey[1]
+		WHERE n.nspname = $1 AND c.relname = $2 AND con.conname = $3 AND con.contype = 'f'
+	`
+	var fk ForeignKey
+	var onDelete, onUpdate string
+	err := t.Tx.QueryRow(ctx, statement, t.DefaultSchema, t.Name, name).Scan(&fk.Schema, &fk.Table, &fk.Column, &onDelete, &onUpdate, &fk.Deferrable, &fk.InitiallyDeferred)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		log.Warningln("While querying for foreign key --> ", name, " in table --> ", t.Name, " error is --> ", err)
+		return nil, &MigrationError{Table: t.Name, Constraint: name, SQL: statement, Err: err}
+	}
+	fk.OnDelete = referentialActions[onDelete]
+	fk.OnUpdate = referentialActions[onUpdate]
+	return &fk, nil
+}
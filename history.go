@@ -0,0 +1,77 @@
+package schemamagic
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// HistoryTableName is the name of the table, in the DefaultSchema of each table, where the executed statements are recorded when RecordHistory is set
+const HistoryTableName = "schemamagic_history"
+
+// historyTable declares the bookkeeping table that stores every statement executed by Begin
+func historyTable(t *Table) *Table {
+	table := NewTable(Table{Name: HistoryTableName, DefaultSchema: t.DefaultSchema, Database: t.Database, Tx: t.Tx})
+	table.Append(NewColumn(Column{Name: "id", Datatype: "bigserial", IsPrimary: true}))
+	table.Append(NewColumn(Column{Name: "table_name", Datatype: "text", IsNotNull: true, DefaultExists: true, DefaultValue: "''", IndexRequired: true}))
+	table.Append(NewColumn(Column{Name: "column_name", Datatype: "text", IsNotNull: true, DefaultExists: true, DefaultValue: "''"}))
+	table.Append(NewColumn(Column{Name: "constraint_name", Datatype: "text", IsNotNull: true, DefaultExists: true, DefaultValue: "''"}))
+	table.Append(NewColumn(Column{Name: "step", Datatype: "integer", IsNotNull: true, DefaultExists: true, DefaultValue: "0"}))
+	table.Append(NewColumn(Column{Name: "statement", Datatype: "text", IsNotNull: true, DefaultExists: true, DefaultValue: "''"}))
+	table.Append(NewColumn(Column{Name: "applied_at", Datatype: "timestamp with time zone", IsNotNull: true, DefaultExists: true, DefaultValue: "now()"}))
+	table.Append(NewColumn(Column{Name: "duration_us", Datatype: "bigint", IsNotNull: true, DefaultExists: true, DefaultValue: "0", Comment: "Time taken to execute the statement, in microseconds"}))
+	table.Append(NewColumn(Column{Name: "app_version", Datatype: "text", IsNotNull: true, DefaultExists: true, DefaultValue: "''"}))
+	table.Append(NewColumn(Column{Name: "definition_hash", Datatype: "text", IsNotNull: true, DefaultExists: true, DefaultValue: "''", Comment: "SHA-256 of the declared table definition"}))
+	return table
+}
+
+// ensureHistoryTable creates (or updates) the history table, once per table
+func (t *Table) ensureHistoryTable(ctx context.Context) error {
+	if t.historyReady {
+		return nil
+	}
+	log.Debugln("Ensuring that the history table exists in schema --> ", t.DefaultSchema)
+	if err := historyTable(t).apply(ctx); err != nil {
+		return err
+	}
+	t.historyReady = true
+	return nil
+}
+
+// recordHistory stores the executed statement in the history table, through the transaction (or, for the statements run outside it, the pool)
+func (t *Table) recordHistory(ctx context.Context, e executor, statement PlannedStatement, duration time.Duration, definitionHash string) error {
+	insert := fmt.Sprintf(`
+		INSERT INTO %s (table_name, column_name, constraint_name, step, statement, duration_us, app_version, definition_hash)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, qualifiedName(t.DefaultSchema, HistoryTableName))
+	_, err := e.Exec(ctx, insert, statement.Table, statement.Column, statement.Constraint, statement.Step, statement.SQL, duration.Microseconds(), t.AppVersion, definitionHash)
+	if err != nil {
+		log.Warningln("Couldn't record statement --> ", statement.SQL, " in the history table, error is --> ", err)
+		return &MigrationError{Table: t.Name, Column: statement.Column, Constraint: statement.Constraint, Step: statement.Step, SQL: insert, Err: err}
+	}
+	return nil
+}
+
+// definitionHash returns the SHA-256 of the declared definition of the table (name, schema, comment, columns, constraints, indexes, sequences and enums), which identifies the version of the declaration that was applied
+func (t *Table) definitionHash() string {
+	definition := struct {
+		Name          string
+		DefaultSchema string
+		Comment       string
+		Columns       []Column
+		Constraints   []Constraint
+		Indexes       []Index
+		Sequences     []Sequence
+		Enums         []Enum
+	}{t.Name, t.DefaultSchema, t.Comment, t.Columns, t.constraints, t.indexes, t.sequences, t.enums}
+	encoded, err := json.Marshal(definition)
+	if err != nil {
+		// Columns, constraints, indexes, sequences and enums only hold plain values, so this is not expected to happen
+		log.Warningln("Couldn't encode the definition of table --> ", t.Name, " error is --> ", err)
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
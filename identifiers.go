@@ -0,0 +1,174 @@
+package schemamagic
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	pgx "github.com/jackc/pgx/v5"
+)
+
+// maxIdentifierLength is the maximum length (in bytes) of an identifier in PostgreSQL. Longer names are silently truncated by PostgreSQL
+const maxIdentifierLength = 63
+
+// quoteIdentifier quotes a schema, table, column, constraint or index name, so that reserved words (timestamp, order, etc.) and mixed case names are used exactly as they are declared
+func quoteIdentifier(name string) string {
+	return pgx.Identifier{name}.Sanitize()
+}
+
+// qualifiedName returns the quoted, schema qualified name of a table, index or sequence
+func qualifiedName(schema string, name string) string {
+	return pgx.Identifier{schema, name}.Sanitize()
+}
+
+// quoteLiteral quotes a string as an SQL literal, such as the text of a comment
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// parseQualifiedName splits an (optionally schema qualified, optionally quoted) name into its parts, the way PostgreSQL reads it: quoted parts are used as they are (with "" read as a quote, and dots kept), while unquoted parts are folded to lower case.
+// false is returned if the name can't be parsed
+func parseQualifiedName(name string) ([]string, bool) {
+	var parts []string
+	rest := strings.TrimSpace(name)
+	for {
+		var part strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			closed := false
+			i := 1
+			for i < len(rest) {
+				if rest[i] == '"' {
+					if i+1 < len(rest) && rest[i+1] == '"' {
+						part.WriteByte('"')
+						i += 2
+						continue
+					}
+					closed = true
+					i++
+					break
+				}
+				part.WriteByte(rest[i])
+				i++
+			}
+			if !closed {
+				return nil, false
+			}
+			rest = rest[i:]
+		} else {
+			end := strings.IndexByte(rest, '.')
+			if end < 0 {
+				end = len(rest)
+			}
+			part.WriteString(strings.ToLower(strings.TrimSpace(rest[:end])))
+			rest = rest[end:]
+		}
+		if part.Len() == 0 {
+			return nil, false
+		}
+		parts = append(parts, part.String())
+		rest = strings.TrimSpace(rest)
+		if rest == "" {
+			return parts, true
+		}
+		if rest[0] != '.' {
+			return nil, false
+		}
+		rest = strings.TrimSpace(rest[1:])
+	}
+}
+
+// qualifiedKey returns the key (as built by tableKey) of an (optionally schema qualified, optionally quoted) name. Unqualified names are assumed to be in defaultSchema
+func qualifiedKey(name string, defaultSchema string) (string, bool) {
+	parts, ok := parseQualifiedName(name)
+	if !ok {
+		return "", false
+	}
+	switch len(parts) {
+	case 1:
+		return tableKey(defaultSchema, parts[0]), true
+	case 2:
+		return tableKey(parts[0], parts[1]), true
+	}
+	return "", false
+}
+
+// validateIdentifier checks that the name can be used as an identifier without being truncated by PostgreSQL
+func validateIdentifier(kind string, name string) error {
+	if name == "" {
+		return fmt.Errorf("%s name is empty", kind)
+	}
+	if len(name) > maxIdentifierLength {
+		return fmt.Errorf("%s name %q is %d bytes long, which is longer than the maximum of %d", kind, name, len(name), maxIdentifierLength)
+	}
+	if strings.ContainsRune(name, 0) {
+		return fmt.Errorf("%s name %q contains a NUL character", kind, name)
+	}
+	return nil
+}
+
+// validate checks the names of the table, its schema, its columns and its constraints (including the ones that are named after the table and the column), and the declared indexes, before any statement is planned
+func (t *Table) validate() error {
+	if err := validateIdentifier("table", t.Name); err != nil {
+		return &MigrationError{Table: t.Name, Err: err}
+	}
+	if err := validateIdentifier("schema", t.DefaultSchema); err != nil {
+		return &MigrationError{Table: t.Name, Err: err}
+	}
+	for _, col := range t.Columns {
+		if err := validateIdentifier("column", col.Name); err != nil {
+			return &MigrationError{Table: t.Name, Column: col.Name, Err: err}
+		}
+		for _, from := range col.RenamedFrom {
+			if err := validateIdentifier("previous column", from); err != nil {
+				return &MigrationError{Table: t.Name, Column: col.Name, Err: err}
+			}
+		}
+		if col.Action == ActionDrop {
+			continue
+		}
+		// The constraints and the index of the column are named after the table and the column. PostgreSQL would truncate a longer name, and the object wouldn't be found (and would be created again) on every run
+		derived := []struct {
+			kind string
+			name string
+			used bool
+		}{
+			{"unique constraint", uniqueConstraintName(t.Name, col.Name), col.IsUnique},
+			{"primary key", primaryKeyName(t.Name, col.Name), col.IsPrimary},
+			{"index", indexName(t.Name, col.Name), col.IndexRequired},
+			{"foreign key", foreignKeyName(t.Name, col.Name), col.References != nil},
+			{"not null check", notNullCheckName(t.Name, col.Name), col.SafeNotNull},
+		}
+		for _, d := range derived {
+			if !d.used {
+				continue
+			}
+			if err := validateIdentifier(d.kind, d.name); err != nil {
+				return &MigrationError{Table: t.Name, Column: col.Name, Err: err}
+			}
+		}
+	}
+	for _, constraint := range t.constraints {
+		if err := validateIdentifier("constraint", constraint.Name); err != nil {
+			return &MigrationError{Table: t.Name, Constraint: constraint.Name, Err: err}
+		}
+	}
+	for _, index := range t.indexes {
+		if err := index.validate(); err != nil {
+			return &MigrationError{Table: t.Name, Index: index.Name, Err: err}
+		}
+	}
+	for _, enum := range t.enums {
+		if err := enum.validate(); err != nil {
+			return &MigrationError{Table: t.Name, Enum: enum.Name, Err: err}
+		}
+	}
+	for _, sequence := range t.sequences {
+		if err := sequence.validate(); err != nil {
+			return &MigrationError{Table: t.Name, Err: err}
+		}
+		if sequence.OwnedBy != "" && !slices.ContainsFunc(t.Columns, func(col Column) bool { return col.Name == sequence.OwnedBy }) {
+			return &MigrationError{Table: t.Name, Column: sequence.OwnedBy, Err: fmt.Errorf("sequence %s is owned by column %s, which is not declared", sequence.Name, sequence.OwnedBy)}
+		}
+	}
+	return nil
+}
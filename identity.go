@@ -0,0 +1,150 @@
+package schemamagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	pgx "github.com/jackc/pgx/v5"
+)
+
+// Kinds of identity columns that can be set in Column.Identity
+const (
+	IdentityAlways    = "ALWAYS"     // Values can't be inserted explicitly, unless OVERRIDING SYSTEM VALUE is used
+	IdentityByDefault = "BY DEFAULT" // Values are generated only when they are not inserted explicitly
+)
+
+// identityKinds maps the codes stored in pg_attribute.attidentity to the kinds of identity columns
+var identityKinds = map[string]string{
+	"a": IdentityAlways,
+	"d": IdentityByDefault,
+}
+
+// identityKind returns the normalized kind of identity
+func identityKind(kind string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(kind), " "))
+}
+
+// validateIdentity checks that the identity of the column can be applied
+func (c *Column) validateIdentity() error {
+	if c.Identity == "" {
+		return nil
+	}
+	switch identityKind(c.Identity) {
+	case IdentityAlways, IdentityByDefault:
+	default:
+		return fmt.Errorf("invalid identity %q", c.Identity)
+	}
+	if strings.Contains(c.Datatype, "serial") {
+		return errors.New("an identity column can't have a serial datatype, use smallint, integer or bigint instead")
+	}
+	if c.DefaultExists {
+		return errors.New("an identity column can't have a default value")
+	}
+	return nil
+}
+
+// identityOptions returns the sequence options of the identity, if any are set
+func (c *Column) identityOptions() string {
+	var options []string
+	if c.IdentityStart != 0 {
+		options = append(options, fmt.Sprintf("START WITH %d", c.IdentityStart))
+	}
+	if c.IdentityIncrement != 0 {
+		options = append(options, fmt.Sprintf("INCREMENT BY %d", c.IdentityIncrement))
+	}
+	if len(options) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%s)", strings.Join(options, " "))
+}
+
+// identityClause returns the clause that makes the column an identity column
+func (c *Column) identityClause() string {
+	return fmt.Sprintf("GENERATED %s AS IDENTITY%s", identityKind(c.Identity), c.identityOptions())
+}
+
+// planIdentity compares the identity of the existing column (from pg_attribute.attidentity) with the declaration, and returns the statements that add, alter or drop it.
+// A serial column (or a plain integer column) that is declared as an identity is converted, and the identity continues from the current value of its sequence (or from the largest value in the column), so that no value is generated twice
+func (t *Table) planIdentity(ctx context.Context, col Column, existingName string, state columnState) ([]PlannedStatement, error) {
+	table := qualifiedName(t.DefaultSchema, t.Name)
+	column := quoteIdentifier(col.Name)
+	statement := func(sql string) PlannedStatement {
+		return PlannedStatement{Table: t.Name, Column: col.Name, Step: StepIdentity, SQL: sql}
+	}
+	current := identityKinds[state.identity]
+	if col.Identity == "" {
+		if current == "" {
+			return nil, nil
+		}
+		log.Debugln("Column --> ", col.Name, " is no longer an identity column")
+		return []PlannedStatement{statement(fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP IDENTITY IF EXISTS", table, column))}, nil
+	}
+	declared := identityKind(col.Identity)
+	if current == "" {
+		// The conversion sets NOT NULL, so the rows are checked for NULLs first, the same way as for IsNotNull
+		if !state.notNull {
+			count, err := t.countNulls(ctx, existingName, true)
+			if err != nil {
+				return nil, err
+			}
+			if count > 0 {
+				log.Warningln("Column --> ", col.Name, " in table --> ", t.Name, " has ", count, " NULL rows, so it can't be converted into an identity column")
+				return nil, &MigrationError{Table: t.Name, Column: col.Name, Step: StepIdentity, Err: fmt.Errorf("%w: %d rows", ErrNullValues, count)}
+			}
+		}
+		log.Debugln("Column --> ", col.Name, " is converted into an identity column")
+		return []PlannedStatement{statement(col.identityConversion(t.Name, t.DefaultSchema, strings.HasPrefix(state.defaultValue, "nextval(")))}, nil
+	}
+	var plan []PlannedStatement
+	if current != declared {
+		plan = append(plan, statement(fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET GENERATED %s", table, column, declared)))
+	}
+	if col.IdentityStart == 0 && col.IdentityIncrement == 0 {
+		return plan, nil
+	}
+	var start, increment int64
+	query := "SELECT s.seqstart, s.seqincrement FROM pg_catalog.pg_sequence s WHERE s.seqrelid = pg_get_serial_sequence($1, $2)::regclass"
+	err := t.Tx.QueryRow(ctx, query, table, existingName).Scan(&start, &increment)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		log.Warningln("While querying for the identity sequence of column --> ", col.Name, " in table --> ", t.Name, " error is --> ", err)
+		return nil, &MigrationError{Table: t.Name, Column: col.Name, SQL: query, Err: err}
+	}
+	// SET START WITH only changes the value that a later RESTART goes back to, and not the next value handed out, which is moved with SequenceRestart and SequenceRestartIfLower
+	if col.IdentityStart != 0 && col.IdentityStart != start {
+		plan = append(plan, statement(fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET START WITH %d", table, column, col.IdentityStart)))
+	}
+	if col.IdentityIncrement != 0 && col.IdentityIncrement != increment {
+		plan = append(plan, statement(fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET INCREMENT BY %d", table, column, col.IdentityIncrement)))
+	}
+	return plan, nil
+}
+
+// identityConversion returns the statement that converts the existing column into an identity column. The identity starts at the next value of the sequence of a serial column (which is dropped, along with the default),
+// or after the largest value in a plain column, and never below IdentityStart. The values are read when the statement is executed, so it is a single DO block
+func (c *Column) identityConversion(tableName string, schema string, serial bool) string {
+	table := qualifiedName(schema, tableName)
+	column := quoteIdentifier(c.Name)
+	increment := ""
+	if c.IdentityIncrement != 0 {
+		increment = fmt.Sprintf(" INCREMENT BY %d", c.IdentityIncrement)
+	}
+	start := fmt.Sprintf("SELECT coalesce(max(%s), 0) + 1 FROM %s INTO next_value;", column, table)
+	if serial {
+		start = fmt.Sprintf(`sequence_name := pg_get_serial_sequence(%s, %s);
+	next_value := nextval(sequence_name::regclass);
+	ALTER TABLE %s ALTER COLUMN %s DROP DEFAULT;
+	EXECUTE format('DROP SEQUENCE %%s', sequence_name);`, quoteLiteral(table), quoteLiteral(c.Name), table, column)
+	}
+	return fmt.Sprintf(`DO $schemamagic$
+DECLARE
+	sequence_name text;
+	next_value bigint;
+BEGIN
+	%s
+	ALTER TABLE %s ALTER COLUMN %s SET NOT NULL;
+	EXECUTE format('ALTER TABLE %s ALTER COLUMN %s ADD GENERATED %s AS IDENTITY (START WITH %%s%s)', greatest(next_value, %d));
+END
+$schemamagic$`, start, table, column, strings.ReplaceAll(table, "'", "''"), strings.ReplaceAll(column, "'", "''"), identityKind(c.Identity), increment, c.IdentityStart)
+}
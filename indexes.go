@@ -0,0 +1,388 @@
+package schemamagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	pgx "github.com/jackc/pgx/v5"
+)
+
+// IndexTableName is the name of the table, in the DefaultSchema of each table, where the definitions of the indexes declared with AddIndex are recorded
+const IndexTableName = "schemamagic_indexes"
+
+// indexMarkerPrefix starts the comment with which earlier versions marked the indexes declared with AddIndex. Such indexes are still recognised as created by AddIndex
+const indexMarkerPrefix = "schemamagic:"
+
+// methodPattern matches the name of an index access method
+var methodPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// IndexColumn is a single element of an Index, which is either a column or an expression
+type IndexColumn struct {
+	Name       string `yaml:"name,omitempty"`       // Name of the column
+	Expression string `yaml:"expression,omitempty"` // SQL expression that is indexed instead of a column, such as lower(email). It is used as it is
+	Descending bool   `yaml:"descending,omitempty"` // Denotes if the element is sorted in descending order
+	Nulls      string `yaml:"nulls,omitempty"`      // FIRST or LAST. Empty leaves the default of the sort order
+}
+
+// Index is an index on one or more columns or expressions of a table, added through Table.AddIndex. The definition of every such index is recorded in IndexTableName, so that it is rebuilt when the definition changes, and dropped when it is no longer declared
+type Index struct {
+	Name         string        `yaml:"name"`                   // Name of the index
+	Columns      []IndexColumn `yaml:"columns"`                // Columns and expressions, in order
+	Unique       bool          `yaml:"unique,omitempty"`       // Denotes if the index is unique
+	Method       string        `yaml:"method,omitempty"`       // Access method: btree (default), hash, gist, spgist, gin, brin, etc.
+	Include      []string      `yaml:"include,omitempty"`      // Columns that are stored in the index without being part of the key
+	Where        string        `yaml:"where,omitempty"`        // Predicate of a partial index. It is used as it is
+	Concurrently bool          `yaml:"concurrently,omitempty"` // Denotes if the index is built and dropped concurrently, on Table.DB after the transaction is committed
+}
+
+// existingIndex is an index of the table as read from pg_catalog, along with its record in IndexTableName (if any)
+type existingIndex struct {
+	definition   string
+	method       string
+	valid        bool
+	comment      string
+	recorded     string // Definition with which the index was built, as recorded in IndexTableName
+	concurrently bool   // Denotes if the index was built concurrently, as recorded in IndexTableName
+}
+
+// owned returns if the index was created through AddIndex
+func (e existingIndex) owned() bool {
+	return e.recorded != "" || strings.HasPrefix(e.comment, indexMarkerPrefix)
+}
+
+// AddIndex accepts an index and appends it to the list of indexes that need to be created on the table
+func (t *Table) AddIndex(index Index) {
+	t.indexes = append(t.indexes, index)
+}
+
+// validate checks that the index can be turned into a valid CREATE INDEX statement
+func (i *Index) validate() error {
+	if err := validateIdentifier("index", i.Name); err != nil {
+		return err
+	}
+	if len(i.Columns) == 0 {
+		return fmt.Errorf("index %s has no columns", i.Name)
+	}
+	for _, col := range i.Columns {
+		if (col.Name == "") == (col.Expression == "") {
+			return fmt.Errorf("every column of index %s needs either a name or an expression", i.Name)
+		}
+		if col.Name != "" {
+			if err := validateIdentifier("index column", col.Name); err != nil {
+				return err
+			}
+		}
+		switch strings.ToUpper(col.Nulls) {
+		case "", "FIRST", "LAST":
+		default:
+			return fmt.Errorf("index %s has an invalid nulls order %q", i.Name, col.Nulls)
+		}
+	}
+	for _, name := range i.Include {
+		if err := validateIdentifier("included column", name); err != nil {
+			return err
+		}
+	}
+	if !methodPattern.MatchString(i.method()) {
+		return fmt.Errorf("index %s has an invalid method %q", i.Name, i.Method)
+	}
+	return nil
+}
+
+// method returns the access method of the index, which defaults to btree
+func (i *Index) method() string {
+	if i.Method == "" {
+		return "btree"
+	}
+	return strings.ToLower(i.Method)
+}
+
+// createStatement returns the CREATE INDEX statement for the index on the table
+func (i *Index) createStatement(tableName string, schema string) string {
+	elements := make([]string, 0, len(i.Columns))
+	for _, col := range i.Columns {
+		element := quoteIdentifier(col.Name)
+		if col.Expression != "" {
+			element = fmt.Sprintf("(%s)", col.Expression)
+		}
+		if col.Descending {
+			element += " DESC"
+		}
+		if col.Nulls != "" {
+			element += " NULLS " + strings.ToUpper(col.Nulls)
+		}
+		elements = append(elements, element)
+	}
+	create := "CREATE INDEX"
+	if i.Unique {
+		create = "CREATE UNIQUE INDEX"
+	}
+	if i.Concurrently {
+		create += " CONCURRENTLY"
+	}
+	statement := fmt.Sprintf("%s %s ON %s USING %s (%s)", create, quoteIdentifier(i.Name), qualifiedName(schema, tableName), i.method(), strings.Join(elements, ", "))
+	if len(i.Include) > 0 {
+		included := make([]string, 0, len(i.Include))
+		for _, name := range i.Include {
+			included = append(included, quoteIdentifier(name))
+		}
+		statement += fmt.Sprintf(" INCLUDE (%s)", strings.Join(included, ", "))
+	}
+	if i.Where != "" {
+		statement += fmt.Sprintf(" WHERE %s", i.Where)
+	}
+	return statement
+}
+
+// definition returns the statement that creates the index, which is recorded in IndexTableName. Whether it is built concurrently is not part of the definition
+func (i *Index) definition(tableName string, schema string) string {
+	definition := *i
+	definition.Concurrently = false
+	return definition.createStatement(tableName, schema)
+}
+
+// planIndexes returns the statements that drop the indexes created through AddIndex that are no longer declared, and create (or rebuild) the declared indexes whose definition has changed
+func (t *Table) planIndexes(ctx context.Context, tablePresence bool) ([]PlannedStatement, error) {
+	existing := make(map[string]existingIndex)
+	if tablePresence {
+		var err error
+		if existing, err = t.fetchIndexes(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if len(existing) > 0 {
+		if err := t.fetchIndexRecords(ctx, existing); err != nil {
+			return nil, err
+		}
+	}
+	declared := make(map[string]bool)
+	for _, index := range t.indexes {
+		declared[index.Name] = true
+	}
+	var undeclared []string
+	for name, index := range existing {
+		if !declared[name] && index.owned() {
+			undeclared = append(undeclared, name)
+		}
+	}
+	sort.Strings(undeclared)
+	var plan []PlannedStatement
+	for _, name := range undeclared {
+		current := existing[name]
+		log.Debugln("Index --> ", name, " is no longer declared and will be dropped")
+		// An index that was built concurrently is dropped concurrently as well, after the commit
+		plan = append(plan, PlannedStatement{Table: t.Name, Index: name, Step: StepDropIndex, SQL: dropIndexStatement(t.DefaultSchema, name, current.concurrently), Concurrent: current.concurrently})
+		if current.recorded != "" {
+			plan = append(plan, PlannedStatement{Table: t.Name, Index: name, Step: StepDropIndex, SQL: t.deleteIndexRecordStatement(name), Concurrent: current.concurrently})
+		}
+	}
+	for _, index := range t.indexes {
+		plan = append(plan, t.planIndex(index, existing)...)
+	}
+	return plan, nil
+}
+
+// planIndex compares the declared index with the existing one of the same name. An index that isn't recorded in IndexTableName (created by hand, or adopted) is compared on the definition returned by pg_get_indexdef, and is only recorded if the definition matches
+func (t *Table) planIndex(index Index, existing map[string]existingIndex) []PlannedStatement {
+	definition := index.definition(t.Name, t.DefaultSchema)
+	record := PlannedStatement{Table: t.Name, Index: index.Name, Step: StepCreateIndex, SQL: t.recordIndexStatement(index), Concurrent: index.Concurrently}
+	current, presence := existing[index.Name]
+	var plan []PlannedStatement
+	if presence && current.valid {
+		if current.recorded == definition {
+			if current.concurrently == index.Concurrently {
+				log.Debugln("Index --> ", index.Name, " is unchanged")
+				return nil
+			}
+			return []PlannedStatement{record}
+		}
+		if current.recorded == "" && normalizeConstraintDefinition(current.definition, t.DefaultSchema) == normalizeConstraintDefinition(definition, t.DefaultSchema) {
+			log.Debugln("Index --> ", index.Name, " matches the declaration and is recorded")
+			return []PlannedStatement{record}
+		}
+	}
+	if presence {
+		log.Debugln("Index --> ", index.Name, " has changed (or is INVALID) and will be rebuilt")
+		plan = append(plan, PlannedStatement{Table: t.Name, Index: index.Name, Step: StepDropIndex, SQL: dropIndexStatement(t.DefaultSchema, index.Name, index.Concurrently), Concurrent: index.Concurrently})
+	}
+	plan = append(plan,
+		PlannedStatement{Table: t.Name, Index: index.Name, Step: StepCreateIndex, SQL: index.createStatement(t.Name, t.DefaultSchema), Concurrent: index.Concurrently},
+		record,
+	)
+	return plan
+}
+
+// recordIndexStatement returns the statement that records the definition of the index in IndexTableName
+func (t *Table) recordIndexStatement(index Index) string {
+	return fmt.Sprintf(
+		"INSERT INTO %s (table_name, index_name, definition, concurrently) VALUES (%s, %s, %s, %t) ON CONFLICT (table_name, index_name) DO UPDATE SET definition = EXCLUDED.definition, concurrently = EXCLUDED.concurrently",
+		qualifiedName(t.DefaultSchema, IndexTableName), quoteLiteral(t.Name), quoteLiteral(index.Name), quoteLiteral(index.definition(t.Name, t.DefaultSchema)), index.Concurrently,
+	)
+}
+
+// deleteIndexRecordStatement returns the statement that removes the record of the dropped index from IndexTableName
+func (t *Table) deleteIndexRecordStatement(name string) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE table_name = %s AND index_name = %s", qualifiedName(t.DefaultSchema, IndexTableName), quoteLiteral(t.Name), quoteLiteral(name))
+}
+
+// indexTable declares the bookkeeping table that stores the definition of every index created through AddIndex
+func indexTable(t *Table) *Table {
+	table := NewTable(Table{Name: IndexTableName, DefaultSchema: t.DefaultSchema, Database: t.Database, Tx: t.Tx})
+	table.Append(NewColumn(Column{Name: "table_name", Datatype: "text", IsNotNull: true, DefaultExists: true, DefaultValue: "''"}))
+	table.Append(NewColumn(Column{Name: "index_name", Datatype: "text", IsNotNull: true, DefaultExists: true, DefaultValue: "''"}))
+	table.Append(NewColumn(Column{Name: "definition", Datatype: "text", IsNotNull: true, DefaultExists: true, DefaultValue: "''", Comment: "Statement with which the index was built"}))
+	table.Append(NewColumn(Column{Name: "concurrently", Datatype: "boolean", IsNotNull: true, DefaultExists: true, DefaultValue: "false"}))
+	table.AddConstraint(Constraint{Name: IndexTableName + "_pkey", Value: "PRIMARY KEY (table_name, index_name)"})
+	return table
+}
+
+// ensureIndexTable creates (or updates) the bookkeeping table of the indexes, once per table, if the plan creates any index declared with AddIndex
+func (t *Table) ensureIndexTable(ctx context.Context, plan []PlannedStatement) error {
+	if t.indexTableReady || !slices.ContainsFunc(plan, func(statement PlannedStatement) bool { return statement.Step == StepCreateIndex }) {
+		return nil
+	}
+	log.Debugln("Ensuring that the index table exists in schema --> ", t.DefaultSchema)
+	if err := indexTable(t).apply(ctx); err != nil {
+		return err
+	}
+	t.indexTableReady = true
+	return nil
+}
+
+// fetchIndexRecords reads the recorded definitions of the indexes of the table from IndexTableName (if it exists) into the existing indexes
+func (t *Table) fetchIndexRecords(ctx context.Context, existing map[string]existingIndex) error {
+	var presence bool
+	statement := `SELECT to_regclass($1) IS NOT NULL`
+	if err := t.Tx.QueryRow(ctx, statement, qualifiedName(t.DefaultSchema, IndexTableName)).Scan(&presence); err != nil {
+		return &MigrationError{Table: t.Name, SQL: statement, Err: err}
+	}
+	if !presence {
+		return nil
+	}
+	statement = fmt.Sprintf("SELECT index_name, definition, concurrently FROM %s WHERE table_name = $1", qualifiedName(t.DefaultSchema, IndexTableName))
+	rows, err := t.Tx.Query(ctx, statement, t.Name)
+	if err != nil {
+		return &MigrationError{Table: t.Name, SQL: statement, Err: err}
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, definition string
+		var concurrently bool
+		if err := rows.Scan(&name, &definition, &concurrently); err != nil {
+			return &MigrationError{Table: t.Name, SQL: statement, Err: err}
+		}
+		// Records of indexes that have been dropped by hand are ignored
+		if index, ok := existing[name]; ok {
+			index.recorded = definition
+			index.concurrently = concurrently
+			existing[name] = index
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return &MigrationError{Table: t.Name, SQL: statement, Err: err}
+	}
+	return nil
+}
+
+// indexColumns are the columns read by fetchIndexes and fetchIndex, in the order of the fields of existingIndex
+const indexColumns = `pg_get_indexdef(i.indexrelid), am.amname::text, i.indisvalid, coalesce(obj_description(i.indexrelid, 'pg_class'), '')`
+
+// dropIndexStatement returns the statement that drops the index, concurrently if required
+func dropIndexStatement(schema string, name string, concurrently bool) string {
+	if concurrently {
+		return fmt.Sprintf("DROP INDEX CONCURRENTLY IF EXISTS %s", qualifiedName(schema, name))
+	}
+	return fmt.Sprintf("DROP INDEX IF EXISTS %s", qualifiedName(schema, name))
+}
+
+// planColumnIndex compares the index of the column (<table>_<column>_index) in pg_index/pg_am with the declaration, and returns the statements that create it, rebuild it when its access method or definition has changed (or it is INVALID), or drop it when IndexRequired is no longer set
+func (t *Table) planColumnIndex(ctx context.Context, col Column, columnPresence bool) ([]PlannedStatement, error) {
+	name := indexName(t.Name, col.Name)
+	current, presence, err := t.fetchIndex(ctx, t.Tx, name)
+	if err != nil {
+		return nil, err
+	}
+	drop := PlannedStatement{Table: t.Name, Column: col.Name, Index: name, Step: StepIndex, SQL: dropIndexStatement(t.DefaultSchema, name, col.IndexConcurrently), Concurrent: col.IndexConcurrently}
+	if !col.IndexRequired {
+		if !presence {
+			return nil, nil
+		}
+		log.Debugln("Index --> ", name, " is no longer required and will be dropped")
+		return []PlannedStatement{drop}, nil
+	}
+	var plan []PlannedStatement
+	if presence {
+		method := col.indexMethod()
+		definition := fmt.Sprintf("CREATE INDEX %s ON %s USING %s (%s)", quoteIdentifier(name), qualifiedName(t.DefaultSchema, t.Name), method, quoteIdentifier(col.Name))
+		if current.valid && current.method == method && normalizeConstraintDefinition(current.definition, t.DefaultSchema) == normalizeConstraintDefinition(definition, t.DefaultSchema) {
+			return nil, nil
+		}
+		log.Debugln("Index --> ", name, " is defined as --> ", current.definition, " (valid: ", current.valid, ") and declared as --> ", definition, ", and will be rebuilt")
+		plan = append(plan, drop)
+	}
+	statement, err := col.prepareSQLStatement(StepIndex, t.Name, t.DefaultSchema, columnPresence)
+	if err != nil {
+		return nil, &MigrationError{Table: t.Name, Column: col.Name, Index: name, Step: StepIndex, Err: err}
+	}
+	plan = append(plan, PlannedStatement{Table: t.Name, Column: col.Name, Index: name, Step: StepIndex, SQL: statement, Concurrent: col.IndexConcurrently})
+	return plan, nil
+}
+
+// fetchIndex reads the definition, access method, validity and comment of the index in the schema of the table, and returns if it exists
+func (t *Table) fetchIndex(ctx context.Context, q queryer, name string) (existingIndex, bool, error) {
+	statement := `
+		SELECT ` + indexColumns + `
+		FROM pg_catalog.pg_index i
+		JOIN pg_catalog.pg_class ic ON ic.oid = i.indexrelid
+		JOIN pg_catalog.pg_am am ON am.oid = ic.relam
+		JOIN pg_catalog.pg_namespace n ON n.oid = ic.relnamespace
+		WHERE n.nspname = $1 AND ic.relname = $2
+	`
+	var index existingIndex
+	err := q.QueryRow(ctx, statement, t.DefaultSchema, name).Scan(&index.definition, &index.method, &index.valid, &index.comment)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return index, false, nil
+	}
+	if err != nil {
+		log.Warningln("While querying for index --> ", name, " error is --> ", err)
+		return index, false, &MigrationError{Table: t.Name, Index: name, SQL: statement, Err: err}
+	}
+	return index, true, nil
+}
+
+// fetchIndexes reads the definition, access method, validity and comment of every index on the table, keyed by the name of the index
+func (t *Table) fetchIndexes(ctx context.Context) (map[string]existingIndex, error) {
+	statement := `
+		SELECT ic.relname, ` + indexColumns + `
+		FROM pg_catalog.pg_index i
+		JOIN pg_catalog.pg_class ic ON ic.oid = i.indexrelid
+		JOIN pg_catalog.pg_am am ON am.oid = ic.relam
+		JOIN pg_catalog.pg_class c ON c.oid = i.indrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1 AND c.relname = $2
+	`
+	rows, err := t.Tx.Query(ctx, statement, t.DefaultSchema, t.Name)
+	if err != nil {
+		return nil, &MigrationError{Table: t.Name, SQL: statement, Err: err}
+	}
+	defer rows.Close()
+	indexes := make(map[string]existingIndex)
+	for rows.Next() {
+		var name string
+		var index existingIndex
+		if err := rows.Scan(&name, &index.definition, &index.method, &index.valid, &index.comment); err != nil {
+			return nil, &MigrationError{Table: t.Name, SQL: statement, Err: err}
+		}
+		indexes[name] = index
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &MigrationError{Table: t.Name, SQL: statement, Err: err}
+	}
+	log.Debugln("Indexes on table --> ", t.Name, " are ", indexes)
+	return indexes, nil
+}
@@ -0,0 +1,331 @@
+package schemamagic
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/format"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Introspect reads pg_catalog for all the tables in the schema, and returns them as Table declarations with their columns and constraints, so that tables created by hand can be adopted.
+// Single column primary keys named <table>_<column>, unique constraints named <table>_<column>_unique, indexes named <table>_<column>_index and serial defaults are folded into the columns, the remaining constraints are returned as Constraint values
+func Introspect(ctx context.Context, db *pgxpool.Pool, database string, schema string) ([]*Table, error) {
+	log.Infoln("Introspecting schema --> ", schema)
+	var tables []*Table
+	byName := make(map[string]*Table)
+	// columns stores the index of every column in its table, keyed by table and column name
+	columns := make(map[string]map[string]int)
+
+	statement := `
+		SELECT c.relname, coalesce(obj_description(c.oid, 'pg_class'), '')
+		FROM pg_catalog.pg_class c
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1 AND c.relkind = 'r'
+		ORDER BY c.relname
+	`
+	rows, err := db.Query(ctx, statement, schema)
+	if err != nil {
+		return nil, &MigrationError{SQL: statement, Err: err}
+	}
+	for rows.Next() {
+		var name, comment string
+		if err := rows.Scan(&name, &comment); err != nil {
+			rows.Close()
+			return nil, &MigrationError{SQL: statement, Err: err}
+		}
+		table := NewTable(Table{Name: name, DefaultSchema: schema, Database: database, Comment: comment})
+		tables = append(tables, table)
+		byName[name] = table
+		columns[name] = make(map[string]int)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, &MigrationError{SQL: statement, Err: err}
+	}
+
+	// Read the columns of all the tables
+	statement = `
+		SELECT c.relname, a.attname::text, format_type(a.atttypid, a.atttypmod), col.data_type, a.attnotnull, coalesce(pg_get_expr(d.adbin, d.adrelid), ''),
+			coalesce(col_description(c.oid, a.attnum), ''), a.attidentity::text,
+			coalesce(col.identity_start, '0')::bigint, coalesce(col.identity_increment, '0')::bigint
+		FROM pg_catalog.pg_attribute a
+		JOIN pg_catalog.pg_class c ON c.oid = a.attrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		JOIN information_schema.columns col ON col.table_schema = n.nspname AND col.table_name = c.relname AND col.column_name = a.attname
+		LEFT JOIN pg_catalog.pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE n.nspname = $1 AND c.relkind = 'r' AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY c.relname, a.attnum
+	`
+	rows, err = db.Query(ctx, statement, schema)
+	if err != nil {
+		return nil, &MigrationError{SQL: statement, Err: err}
+	}
+	for rows.Next() {
+		var tableName, name, datatype, dataType, defaultValue, comment, identity string
+		var notNull bool
+		var identityStart, identityIncrement int64
+		if err := rows.Scan(&tableName, &name, &datatype, &dataType, &notNull, &defaultValue, &comment, &identity, &identityStart, &identityIncrement); err != nil {
+			rows.Close()
+			return nil, &MigrationError{Table: tableName, SQL: statement, Err: err}
+		}
+		table, ok := byName[tableName]
+		if !ok {
+			continue
+		}
+		col := Column{Name: name, Datatype: datatype, IsNotNull: notNull, Comment: comment}
+		if dataType != datatype {
+			// PostgreSQL reports a different name in INFORMATION_SCHEMA (ARRAY, USER-DEFINED, character varying, etc.)
+			col.PseudoDatatype = dataType
+		}
+		if kind := identityKinds[identity]; kind != "" {
+			col.Identity = kind
+			// The defaults of PostgreSQL are left out
+			if identityStart != 1 {
+				col.IdentityStart = identityStart
+			}
+			if identityIncrement != 1 {
+				col.IdentityIncrement = identityIncrement
+			}
+		} else if serial := serialDatatype(datatype, defaultValue); serial != "" {
+			col.Datatype = serial
+			col.PseudoDatatype = ""
+		} else if defaultValue != "" {
+			col.DefaultExists = true
+			col.DefaultValue = defaultValue
+		}
+		columns[tableName][name] = len(table.Columns)
+		table.Append(col)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, &MigrationError{SQL: statement, Err: err}
+	}
+
+	// Read the constraints of all the tables
+	statement = `
+		SELECT c.relname, con.conname, con.contype::text, pg_get_constraintdef(con.oid),
+			coalesce((SELECT array_agg(a.attname::text ORDER BY k.ord) FROM unnest(con.conkey) WITH ORDINALITY k(attnum, ord) JOIN pg_catalog.pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum), '{}'::text[]),
+			coalesce(rn.nspname::text, ''), coalesce(rc.relname::text, ''), coalesce(ra.attname::text, ''), con.confdeltype::text, con.confupdtype::text, con.condeferrable, con.condeferred,
+			coalesce(array_length(con.confkey, 1), 0)
+		FROM pg_catalog.pg_constraint con
+		JOIN pg_catalog.pg_class c ON c.oid = con.conrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_catalog.pg_class rc ON rc.oid = con.confrelid
+		LEFT JOIN pg_catalog.pg_namespace rn ON rn.oid = rc.relnamespace
+		LEFT JOIN pg_catalog.pg_attribute ra ON ra.attrelid = con.confrelid AND ra.attnum = con.confkey[1]
+		WHERE n.nspname = $1 AND c.relkind = 'r' AND con.contype IN ('p', 'u', 'f', 'c', 'x')
+		ORDER BY c.relname, con.conname
+	`
+	rows, err = db.Query(ctx, statement, schema)
+	if err != nil {
+		return nil, &MigrationError{SQL: statement, Err: err}
+	}
+	for rows.Next() {
+		var tableName, name, kind, definition string
+		var keys []string
+		var fk ForeignKey
+		var onDelete, onUpdate string
+		var referencedKeys int
+		if err := rows.Scan(&tableName, &name, &kind, &definition, &keys, &fk.Schema, &fk.Table, &fk.Column, &onDelete, &onUpdate, &fk.Deferrable, &fk.InitiallyDeferred, &referencedKeys); err != nil {
+			rows.Close()
+			return nil, &MigrationError{Table: tableName, SQL: statement, Err: err}
+		}
+		table, ok := byName[tableName]
+		if !ok {
+			continue
+		}
+		if len(keys) == 1 {
+			index, ok := columns[tableName][keys[0]]
+			// A primary key with another name (such as the <table>_pkey of PRIMARY KEY in CREATE TABLE) is kept as a constraint, since IsPrimary would add a second one under <table>_<column>
+			if ok && kind == "p" && name == primaryKeyName(tableName, keys[0]) {
+				table.Columns[index].IsPrimary = true
+				continue
+			}
+			if ok && kind == "u" && name == uniqueConstraintName(tableName, keys[0]) {
+				table.Columns[index].IsUnique = true
+				continue
+			}
+			if ok && kind == "f" && referencedKeys == 1 && name == foreignKeyName(tableName, keys[0]) {
+				if fk.Schema == schema {
+					fk.Schema = ""
+				}
+				if fk.OnDelete = referentialActions[onDelete]; fk.OnDelete == NoAction {
+					fk.OnDelete = ""
+				}
+				if fk.OnUpdate = referentialActions[onUpdate]; fk.OnUpdate == NoAction {
+					fk.OnUpdate = ""
+				}
+				table.Columns[index].References = &fk
+				continue
+			}
+		}
+		table.AddConstraint(Constraint{Name: name, Value: definition})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, &MigrationError{SQL: statement, Err: err}
+	}
+
+	// Read the indexes that are named after a single column, and are not backing a constraint
+	statement = `
+		SELECT t.relname, i.relname, am.amname, a.attname
+		FROM pg_catalog.pg_index x
+		JOIN pg_catalog.pg_class t ON t.oid = x.indrelid
+		JOIN pg_catalog.pg_class i ON i.oid = x.indexrelid
+		JOIN pg_catalog.pg_am am ON am.oid = i.relam
+		JOIN pg_catalog.pg_namespace n ON n.oid = t.relnamespace
+		JOIN pg_catalog.pg_attribute a ON a.attrelid = t.oid AND a.attnum = x.indkey[0]
+		WHERE n.nspname = $1 AND t.relkind = 'r' AND x.indnatts = 1 AND x.indexprs IS NULL AND x.indpred IS NULL
+		AND NOT EXISTS (SELECT 1 FROM pg_catalog.pg_constraint con WHERE con.conindid = x.indexrelid)
+	`
+	rows, err = db.Query(ctx, statement, schema)
+	if err != nil {
+		return nil, &MigrationError{SQL: statement, Err: err}
+	}
+	for rows.Next() {
+		var tableName, name, method, columnName string
+		if err := rows.Scan(&tableName, &name, &method, &columnName); err != nil {
+			rows.Close()
+			return nil, &MigrationError{Table: tableName, SQL: statement, Err: err}
+		}
+		index, ok := columns[tableName][columnName]
+		if !ok || name != indexName(tableName, columnName) {
+			log.Debugln("Skipping index --> ", name, " on table --> ", tableName)
+			continue
+		}
+		byName[tableName].Columns[index].IndexRequired = true
+		if method != "btree" {
+			byName[tableName].Columns[index].IndexType = method
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, &MigrationError{SQL: statement, Err: err}
+	}
+
+	for _, table := range tables {
+		for i, col := range table.Columns {
+			table.Columns[i] = NewColumn(col)
+		}
+	}
+	return tables, nil
+}
+
+// serialDatatype returns serial, bigserial or smallserial if the column is backed by a sequence through its default value, otherwise it returns an empty string
+func serialDatatype(datatype string, defaultValue string) string {
+	if !strings.HasPrefix(defaultValue, "nextval(") {
+		return ""
+	}
+	switch datatype {
+	case "bigint":
+		return "bigserial"
+	case "integer":
+		return "serial"
+	case "smallint":
+		return "smallserial"
+	}
+	return ""
+}
+
+// GenerateSource returns gofmt-ed Go source, in the package passed, with one function per table that declares the table using NewTable, NewColumn, Append and AddConstraint
+func GenerateSource(packageName string, tables []*Table) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by schemamagic.GenerateSource.\n\npackage %s\n\n", packageName)
+	buf.WriteString("import (\n\tpgx \"github.com/jackc/pgx/v5\"\n\t\"github.com/apratheek/schemamagic\"\n)\n")
+	// generated stores the names of the functions generated so far, since table names that only differ in case or separators (a_b and a-b) map to the same name
+	generated := make(map[string]bool)
+	for _, table := range tables {
+		name := functionName(table.Name)
+		for suffix := 2; generated[name]; suffix++ {
+			name = fmt.Sprintf("%s%d", functionName(table.Name), suffix)
+		}
+		generated[name] = true
+		fmt.Fprintf(&buf, "\n// %s declares the table %s.%s\n", name, table.DefaultSchema, table.Name)
+		fmt.Fprintf(&buf, "func %s(tx pgx.Tx) *schemamagic.Table {\n", name)
+		comment := ""
+		if table.Comment != "" {
+			comment = fmt.Sprintf(", Comment: %q", table.Comment)
+		}
+		fmt.Fprintf(&buf, "table := schemamagic.NewTable(schemamagic.Table{Name: %q, DefaultSchema: %q, Database: %q%s, Tx: tx})\n", table.Name, table.DefaultSchema, table.Database, comment)
+		for _, col := range table.Columns {
+			fmt.Fprintf(&buf, "table.Append(schemamagic.NewColumn(schemamagic.Column{%s}))\n", columnLiteral(col))
+		}
+		for _, constraint := range table.constraints {
+			fmt.Fprintf(&buf, "table.AddConstraint(schemamagic.Constraint{Name: %q, Value: %q})\n", constraint.Name, constraint.Value)
+		}
+		buf.WriteString("return table\n}\n")
+	}
+	return format.Source(buf.Bytes())
+}
+
+// columnLiteral returns the fields of the column that are not set to their defaults, as Go source
+func columnLiteral(c Column) string {
+	fields := []string{fmt.Sprintf("Name: %q", c.Name), fmt.Sprintf("Datatype: %q", c.Datatype)}
+	if c.PseudoDatatype != "" {
+		fields = append(fields, fmt.Sprintf("PseudoDatatype: %q", c.PseudoDatatype))
+	}
+	if c.DefaultExists {
+		fields = append(fields, "DefaultExists: true", fmt.Sprintf("DefaultValue: %q", c.DefaultValue))
+	}
+	if c.IsUnique {
+		fields = append(fields, "IsUnique: true")
+	}
+	if c.IsPrimary {
+		fields = append(fields, "IsPrimary: true")
+	}
+	if c.IsNotNull {
+		fields = append(fields, "IsNotNull: true")
+	}
+	if c.IndexRequired {
+		fields = append(fields, "IndexRequired: true")
+	}
+	if c.IndexType != "" {
+		fields = append(fields, fmt.Sprintf("IndexType: %q", c.IndexType))
+	}
+	if c.Identity != "" {
+		fields = append(fields, fmt.Sprintf("Identity: %q", c.Identity))
+	}
+	if c.IdentityStart != 0 {
+		fields = append(fields, fmt.Sprintf("IdentityStart: %d", c.IdentityStart))
+	}
+	if c.IdentityIncrement != 0 {
+		fields = append(fields, fmt.Sprintf("IdentityIncrement: %d", c.IdentityIncrement))
+	}
+	if c.Comment != "" {
+		fields = append(fields, fmt.Sprintf("Comment: %q", c.Comment))
+	}
+	if f := c.References; f != nil {
+		reference := []string{fmt.Sprintf("Table: %q", f.Table), fmt.Sprintf("Column: %q", f.Column)}
+		if f.Schema != "" {
+			reference = append([]string{fmt.Sprintf("Schema: %q", f.Schema)}, reference...)
+		}
+		if f.OnDelete != "" {
+			reference = append(reference, fmt.Sprintf("OnDelete: %q", f.OnDelete))
+		}
+		if f.OnUpdate != "" {
+			reference = append(reference, fmt.Sprintf("OnUpdate: %q", f.OnUpdate))
+		}
+		if f.Deferrable {
+			reference = append(reference, "Deferrable: true")
+		}
+		if f.InitiallyDeferred {
+			reference = append(reference, "InitiallyDeferred: true")
+		}
+		fields = append(fields, fmt.Sprintf("References: &schemamagic.ForeignKey{%s}", strings.Join(reference, ", ")))
+	}
+	return strings.Join(fields, ", ")
+}
+
+// functionName converts a table name into the name of the function that declares it. Eg.: tax_params --> tableTaxParams
+func functionName(tableName string) string {
+	name := "table"
+	for _, part := range strings.FieldsFunc(tableName, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}) {
+		name += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return name
+}
@@ -0,0 +1,193 @@
+package schemamagic
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// schemaFile is the top level of a declarative schema file. The database and schema set here apply to every table that doesn't set its own
+type schemaFile struct {
+	Database string      `yaml:"database"`
+	Schema   string      `yaml:"schema"`
+	Tables   []tableFile `yaml:"tables"`
+}
+
+// tableFile declares a single table in a schema file. Columns, constraints, indexes, sequences and enums accept the same keys as the yaml tags on Column, Constraint, Index, Sequence and Enum
+type tableFile struct {
+	Name        string       `yaml:"name"`
+	Schema      string       `yaml:"schema"`
+	Database    string       `yaml:"database"`
+	PruneMode   string       `yaml:"prune_mode"`
+	Comment     string       `yaml:"comment"`
+	Columns     []Column     `yaml:"columns"`
+	Constraints []Constraint `yaml:"constraints"`
+	Indexes     []Index      `yaml:"indexes"`
+	Sequences   []Sequence   `yaml:"sequences"`
+	Enums       []Enum       `yaml:"enums"`
+}
+
+// LoadFile reads a declarative schema file (YAML or JSON) and returns the tables declared in it. See Load for the format
+func LoadFile(path string) ([]*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tables, err := Load(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return tables, nil
+}
+
+// Load parses a declarative schema in YAML (or JSON, which is valid YAML) and returns the tables declared in it, with their columns and constraints.
+// Unknown keys, values of the wrong type and missing names/datatypes are reported along with their line numbers. The tables are returned without a Tx, which needs to be set before calling Begin (or the tables can be appended to a Schema)
+func Load(r io.Reader) ([]*Table, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var file schemaFile
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("schemamagic: %w", err)
+	}
+	// Decode the file again as a node tree, to report the line numbers of the semantic errors
+	var root yaml.Node
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		return nil, fmt.Errorf("schemamagic: %w", err)
+	}
+	tablesNode := mappingValue(documentNode(&root), "tables")
+
+	var tables []*Table
+	for i, t := range file.Tables {
+		tableNode := sequenceItem(tablesNode, i)
+		if t.Name == "" {
+			return nil, lineError(tableNode, "table name is empty")
+		}
+		if t.PruneMode != PruneOff && t.PruneMode != PruneWarn && t.PruneMode != PruneDrop {
+			return nil, lineError(mappingValue(tableNode, "prune_mode"), fmt.Sprintf("table %s has an invalid prune_mode %q", t.Name, t.PruneMode))
+		}
+		table := NewTable(Table{Name: t.Name, DefaultSchema: firstNonEmpty(t.Schema, file.Schema, "public"), Database: firstNonEmpty(t.Database, file.Database), PruneMode: t.PruneMode, Comment: t.Comment})
+
+		columnsNode := mappingValue(tableNode, "columns")
+		declared := make(map[string]bool)
+		for j, col := range t.Columns {
+			columnNode := sequenceItem(columnsNode, j)
+			switch {
+			case col.Name == "":
+				return nil, lineError(columnNode, fmt.Sprintf("column in table %s has an empty name", t.Name))
+			case declared[col.Name]:
+				return nil, lineError(columnNode, fmt.Sprintf("column %s is declared more than once in table %s", col.Name, t.Name))
+			case col.Action != "" && col.Action != ActionAdd && col.Action != ActionDrop:
+				return nil, lineError(mappingValue(columnNode, "action"), fmt.Sprintf("column %s has an invalid action %q", col.Name, col.Action))
+			case col.Datatype == "" && col.Action != ActionDrop:
+				return nil, lineError(columnNode, fmt.Sprintf("column %s in table %s has an empty datatype", col.Name, t.Name))
+			}
+			if err := col.validateBackfill(); err != nil {
+				return nil, lineError(columnNode, fmt.Sprintf("column %s in table %s: %v", col.Name, t.Name, err))
+			}
+			if err := col.validateIdentity(); err != nil {
+				return nil, lineError(columnNode, fmt.Sprintf("column %s in table %s: %v", col.Name, t.Name, err))
+			}
+			if err := col.validateSequence(); err != nil {
+				return nil, lineError(columnNode, fmt.Sprintf("column %s in table %s: %v", col.Name, t.Name, err))
+			}
+			declared[col.Name] = true
+			table.Append(NewColumn(col))
+		}
+
+		constraintsNode := mappingValue(tableNode, "constraints")
+		for j, constraint := range t.Constraints {
+			if err := constraint.validate(); err != nil {
+				return nil, lineError(sequenceItem(constraintsNode, j), fmt.Sprintf("table %s: %v", t.Name, err))
+			}
+			table.AddConstraint(constraint)
+		}
+
+		indexesNode := mappingValue(tableNode, "indexes")
+		for j, index := range t.Indexes {
+			if err := index.validate(); err != nil {
+				return nil, lineError(sequenceItem(indexesNode, j), fmt.Sprintf("table %s: %v", t.Name, err))
+			}
+			table.AddIndex(index)
+		}
+
+		sequencesNode := mappingValue(tableNode, "sequences")
+		for j, sequence := range t.Sequences {
+			if err := sequence.validate(); err != nil {
+				return nil, lineError(sequenceItem(sequencesNode, j), fmt.Sprintf("table %s: %v", t.Name, err))
+			}
+			if sequence.OwnedBy != "" && !declared[sequence.OwnedBy] {
+				return nil, lineError(mappingValue(sequenceItem(sequencesNode, j), "owned_by"), fmt.Sprintf("sequence %s is owned by column %s, which is not declared in table %s", sequence.Name, sequence.OwnedBy, t.Name))
+			}
+			table.AddSequence(sequence)
+		}
+
+		enumsNode := mappingValue(tableNode, "enums")
+		for j, enum := range t.Enums {
+			if err := enum.validate(); err != nil {
+				return nil, lineError(sequenceItem(enumsNode, j), fmt.Sprintf("table %s: %v", t.Name, err))
+			}
+			table.AddEnum(enum)
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+// lineError returns an error that points at the line of the node
+func lineError(node *yaml.Node, message string) error {
+	if node == nil {
+		return fmt.Errorf("schemamagic: %s", message)
+	}
+	return fmt.Errorf("schemamagic: line %d: %s", node.Line, message)
+}
+
+// documentNode returns the content of a document node
+func documentNode(node *yaml.Node) *yaml.Node {
+	if node != nil && node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		return node.Content[0]
+	}
+	return node
+}
+
+// mappingValue returns the value of the key in a mapping node, or nil if the key is absent
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// sequenceItem returns the item at index i of a sequence node, or nil if it's absent
+func sequenceItem(node *yaml.Node, i int) *yaml.Node {
+	if node == nil || node.Kind != yaml.SequenceNode || i >= len(node.Content) {
+		return nil
+	}
+	return node.Content[i]
+}
+
+// firstNonEmpty returns the first of the values that is not empty
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
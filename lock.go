@@ -0,0 +1,103 @@
+package schemamagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	pgx "github.com/jackc/pgx/v5"
+)
+
+// ErrLockTimeout is returned (wrapped in a *MigrationError) when the migration lock could not be acquired within the LockTimeout
+var ErrLockTimeout = errors.New("timed out waiting for the migration lock")
+
+// lockPollInterval is the interval at which the migration lock is retried while another instance holds it
+const lockPollInterval = 100 * time.Millisecond
+
+// lockKey returns the key of the advisory lock that guards the migration of a schema in a database
+func lockKey(database string, schema string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(fmt.Sprintf("schemamagic:%s.%s", database, schema)))
+	return int64(h.Sum64())
+}
+
+// acquireLock takes the transaction level advisory lock on the database and schema, which is released when the transaction commits or rolls back. A timeout of 0 waits until the context is done
+func acquireLock(ctx context.Context, tx pgx.Tx, database string, schema string, timeout time.Duration) error {
+	key := lockKey(database, schema)
+	started := time.Now()
+	waited := false
+	for {
+		var acquired bool
+		if err := tx.QueryRow(ctx, "SELECT pg_try_advisory_xact_lock($1)", key).Scan(&acquired); err != nil {
+			return err
+		}
+		if acquired {
+			log.Debugln("Acquired the migration lock on --> ", database, ".", schema, " after ", time.Since(started))
+			return nil
+		}
+		if !waited {
+			log.Infoln("Waiting for another instance to finish migrating --> ", database, ".", schema)
+			waited = true
+		}
+		if timeout > 0 && time.Since(started) >= timeout {
+			return ErrLockTimeout
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// lock acquires the migration lock for the table, if Lock is set. The table is planned once the lock is held, so an instance that waited for another one to migrate the table plans against the migrated table
+func (t *Table) lock(ctx context.Context) error {
+	if !t.Lock {
+		return nil
+	}
+	if err := acquireLock(ctx, t.Tx, t.Database, t.DefaultSchema, t.LockTimeout); err != nil {
+		log.Warningln("Couldn't acquire the migration lock for table --> ", t.Name, " error is --> ", err)
+		return &MigrationError{Table: t.Name, Err: err}
+	}
+	return nil
+}
+
+// planChanges returns if the plan changes the table, which isn't the case when it only holds the CREATE SCHEMA IF NOT EXISTS that every plan starts with. Such a plan is not executed (nor recorded in the history table), which is how the tables that are already in the declared state, such as the ones just migrated by another instance, are skipped
+func planChanges(plan []PlannedStatement) bool {
+	for _, statement := range plan {
+		if statement.Step != StepCreateSchema {
+			return true
+		}
+	}
+	return false
+}
+
+// lock acquires the migration lock on every database and schema of the tables, if Lock is set. The locks are acquired in a fixed order so that two instances can't deadlock on them
+func (s *Schema) lock(ctx context.Context) error {
+	if !s.Lock {
+		return nil
+	}
+	type target struct{ database, schema string }
+	seen := make(map[target]bool)
+	var targets []target
+	for _, table := range s.Tables {
+		key := target{table.Database, table.DefaultSchema}
+		if !seen[key] {
+			seen[key] = true
+			targets = append(targets, key)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return lockKey(targets[i].database, targets[i].schema) < lockKey(targets[j].database, targets[j].schema)
+	})
+	for _, target := range targets {
+		if err := acquireLock(ctx, s.Tx, target.database, target.schema, s.LockTimeout); err != nil {
+			log.Warningln("Couldn't acquire the migration lock for schema --> ", target.schema, " error is --> ", err)
+			return &MigrationError{Err: err}
+		}
+	}
+	return nil
+}
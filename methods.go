@@ -25,7 +25,8 @@ func SetupDB(ctx context.Context, dbHost string, port uint16, database string, s
 	var connectionString = fmt.Sprintf("postgresql://%s:%s@%s:%d/%s?pool_max_conns=%d&search_path=%s", username, url.QueryEscape(password), dbHost, port, database, maxConn, schema)
 	config, err := pgxpool.ParseConfig(connectionString)
 	if err != nil {
-		log.Fatalln("Couldn't parse config: ", err)
+		log.Warningln("Couldn't parse config: ", err)
+		return nil, err
 	}
 
 	config.AfterConnect = func(ctx context.Context, c *pgx.Conn) error {
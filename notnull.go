@@ -0,0 +1,72 @@
+package schemamagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrNullValues is returned (wrapped in a *MigrationError, along with the number of rows) when NOT NULL can't be set on a column, since some of its rows are NULL
+var ErrNullValues = errors.New("the column contains NULL values")
+
+// notNullCheckName returns the name of the temporary check constraint that is used to set NOT NULL on the column without a long lock
+func notNullCheckName(tableName string, columnName string) string {
+	return fmt.Sprintf("%s_%s_not_null", tableName, columnName)
+}
+
+// planNotNull returns the statements that set NOT NULL on the column, if it isn't already. The rows are first checked for NULLs (unless they are being filled with the default), so that a clear error is returned instead of a failed statement.
+// With SafeNotNull, NOT NULL is set after the transaction is committed, through a NOT VALID check constraint that is validated without blocking writes, so that SET NOT NULL doesn't need to scan the table
+func (t *Table) planNotNull(ctx context.Context, col Column, existingName string, columnPresence bool, notNull bool, filled bool) ([]PlannedStatement, error) {
+	if !col.IsNotNull || notNull {
+		return nil, nil
+	}
+	if !filled {
+		count, err := t.countNulls(ctx, existingName, columnPresence)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			log.Warningln("Column --> ", col.Name, " in table --> ", t.Name, " has ", count, " NULL rows, so NOT NULL can't be set")
+			return nil, &MigrationError{Table: t.Name, Column: col.Name, Step: StepNotNull, Err: fmt.Errorf("%w: %d rows", ErrNullValues, count)}
+		}
+	}
+	statement, err := col.prepareSQLStatement(StepNotNull, t.Name, t.DefaultSchema, columnPresence)
+	if err != nil {
+		return nil, &MigrationError{Table: t.Name, Column: col.Name, Step: StepNotNull, Err: err}
+	}
+	if !col.SafeNotNull {
+		return []PlannedStatement{{Table: t.Name, Column: col.Name, Step: StepNotNull, SQL: statement}}, nil
+	}
+	check := Constraint{Name: notNullCheckName(t.Name, col.Name), Value: fmt.Sprintf("CHECK (%s IS NOT NULL) NOT VALID", quoteIdentifier(col.Name))}
+	table := qualifiedName(t.DefaultSchema, t.Name)
+	var plan []PlannedStatement
+	for _, sql := range []string{
+		check.createDropRule(t.Name, t.DefaultSchema),
+		check.createAddRule(t.Name, t.DefaultSchema),
+		fmt.Sprintf("ALTER TABLE %s VALIDATE CONSTRAINT %s", table, quoteIdentifier(check.Name)),
+		statement,
+		check.createDropRule(t.Name, t.DefaultSchema),
+	} {
+		plan = append(plan, PlannedStatement{Table: t.Name, Column: col.Name, Constraint: check.Name, Step: StepNotNull, SQL: sql, Concurrent: true})
+	}
+	return plan, nil
+}
+
+// countNulls returns the number of rows in which the column is NULL. For a column that is yet to be added, that is every row of the table
+func (t *Table) countNulls(ctx context.Context, columnName string, columnPresence bool) (int64, error) {
+	table := qualifiedName(t.DefaultSchema, t.Name)
+	statement := fmt.Sprintf("SELECT count(*) FROM %s WHERE %s IS NULL", table, quoteIdentifier(columnName))
+	if !columnPresence {
+		presence, err := t.checkTableExistence(ctx)
+		if err != nil || !presence {
+			return 0, err
+		}
+		statement = fmt.Sprintf("SELECT count(*) FROM %s", table)
+	}
+	var count int64
+	if err := t.Tx.QueryRow(ctx, statement).Scan(&count); err != nil {
+		log.Warningln("While counting the NULL rows of column --> ", columnName, " in table --> ", t.Name, " error is --> ", err)
+		return 0, &MigrationError{Table: t.Name, Column: columnName, SQL: statement, Err: err}
+	}
+	return count, nil
+}
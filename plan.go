@@ -0,0 +1,225 @@
+package schemamagic
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Steps that produce the statements in a plan. Steps 1 to 8 and 101 are the column steps executed by Column.prepareSQLStatement, the rest are table level steps
+const (
+	StepAddColumn       = 1   // Adds the column without a default value
+	StepSetDefault      = 2   // Sets the default value of the column
+	StepBackfillDefault = 3   // Updates the existing rows with the default value
+	StepRestartSequence = 4   // Restarts the sequence of a serial or identity column
+	StepUnique          = 5   // Adds the unique constraint on the column
+	StepPrimaryKey      = 6   // Adds the primary key constraint on the column
+	StepNotNull         = 7   // Sets NOT NULL on the column
+	StepIndex           = 8   // Creates the index on the column
+	StepForeignKey      = 9   // Adds (or re-creates) the foreign key declared on the column
+	StepComment         = 10  // Sets the comment of the column
+	StepIdentity        = 11  // Adds, alters or drops the identity of an existing column
+	StepSequenceOptions = 12  // Alters the minimum, maximum, cache and cycle of the sequence of a serial or identity column
+	StepAlterDatatype   = 101 // Alters the datatype of an existing column
+	StepDropColumn      = 102 // Drops a column that has the Drop action, or that is no longer declared (when pruning)
+	StepRenameColumn    = 103 // Renames a column from one of its previous names
+	StepDropUnique      = 104 // Drops the unique constraint of a column that is no longer unique
+	StepDropPrimaryKey  = 105 // Drops the primary key constraint of a column that is no longer the primary key
+	StepDropDefault     = 106 // Drops the default value of a column that no longer has one
+	StepDropNotNull     = 107 // Drops NOT NULL from a column that is no longer declared NOT NULL
+	StepCreateSchema    = 201 // Creates the schema of the table
+	StepCreateTable     = 202 // Creates the table
+	StepTableComment    = 203 // Sets the comment of the table
+	StepCreateSequence  = 204 // Creates a sequence declared with AddSequence
+	StepAlterSequence   = 205 // Alters the options of a sequence declared with AddSequence that have changed
+	StepSequenceOwner   = 206 // Makes the declared column own a sequence declared with AddSequence
+	StepCreateEnum      = 207 // Creates an enum declared with AddEnum
+	StepAddEnumValue    = 208 // Adds a label that is missing from an enum declared with AddEnum
+	StepDropConstraint  = 301 // Drops a table constraint
+	StepAddConstraint   = 302 // Adds a table constraint
+	StepDropIndex       = 303 // Drops an index declared with AddIndex that has changed, or that is no longer declared
+	StepCreateIndex     = 304 // Creates an index declared with AddIndex, and records its definition in IndexTableName
+)
+
+// PlannedStatement is a single SQL statement that Begin would execute on a table
+type PlannedStatement struct {
+	Table      string // Name of the table that the statement operates on
+	Column     string // Name of the column that produced this statement, if any
+	Constraint string // Name of the constraint that produced this statement, if any
+	Index      string // Name of the index that the statement operates on, if any
+	Enum       string // Name of the enum that the statement operates on, if any
+	Step       int    // Step that produced this statement (one of the Step constants)
+	SQL        string // The statement that would be executed
+	Concurrent bool   // Denotes if the statement runs outside the transaction, on Table.DB, after the transaction is committed
+	batch      *batchedUpdate
+	added      *addedLabel
+}
+
+// String returns the statement along with a comment describing where it came from
+func (p PlannedStatement) String() string {
+	source := p.Table
+	if p.Column != "" {
+		source = fmt.Sprintf("%s.%s", p.Table, p.Column)
+	} else if p.Constraint != "" {
+		source = fmt.Sprintf("%s (constraint %s)", p.Table, p.Constraint)
+	} else if p.Index != "" {
+		source = fmt.Sprintf("%s (index %s)", p.Table, p.Index)
+	} else if p.Enum != "" {
+		source = fmt.Sprintf("%s (enum %s)", p.Table, p.Enum)
+	}
+	if p.Concurrent {
+		return fmt.Sprintf("-- %s, step %d, after commit\n%s;", source, p.Step, p.SQL)
+	}
+	return fmt.Sprintf("-- %s, step %d\n%s;", source, p.Step, p.SQL)
+}
+
+// FormatPlan joins the planned statements into a single SQL script that can be reviewed before running Begin
+func FormatPlan(plan []PlannedStatement) string {
+	statements := make([]string, 0, len(plan))
+	for _, p := range plan {
+		statements = append(statements, p.String())
+	}
+	return strings.Join(statements, "\n\n")
+}
+
+// Plan introspects the table in the database and returns the ordered list of statements that Begin would execute, without executing any of them
+func (t *Table) Plan(ctx context.Context) ([]PlannedStatement, error) {
+	return t.plan(ctx, nil, nil)
+}
+
+// plan returns the statements for the table, leaving out the constraints whose names are present in skip. added holds the labels that are added to enums earlier in the same transaction (by the tables applied before this one in a Schema)
+func (t *Table) plan(ctx context.Context, skip map[string]bool, added []addedLabel) ([]PlannedStatement, error) {
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	plan := []PlannedStatement{
+		{Table: t.Name, Step: StepCreateSchema, SQL: fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", quoteIdentifier(t.DefaultSchema))},
+	}
+	// The enums are created before the table, since its columns can use them
+	enumPlan, err := t.planEnums(ctx)
+	if err != nil {
+		return nil, err
+	}
+	plan = append(plan, enumPlan...)
+	//  Check if table exists in the database
+	presence, err := t.checkTableExistence(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !presence {
+		// Table does not exist --> need to create it
+		plan = append(plan, PlannedStatement{Table: t.Name, Step: StepCreateTable, SQL: fmt.Sprintf("CREATE TABLE %s()", qualifiedName(t.DefaultSchema, t.Name))})
+	}
+	commentPlan, err := t.planTableComment(ctx, presence)
+	if err != nil {
+		return nil, err
+	}
+	plan = append(plan, commentPlan...)
+	// The sequences are created before the columns, whose defaults can use them
+	sequencePlan, err := t.planSequences(ctx)
+	if err != nil {
+		return nil, err
+	}
+	plan = append(plan, sequencePlan...)
+	// Loop over all the available columns and plan the statements for each column
+	for _, col := range t.Columns {
+		log.Debugln("-----------------------------------------------")
+		colPlan, err := t.planColumn(ctx, col)
+		log.Debugln("-----------------------------------------------")
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, colPlan...)
+	}
+	ownerPlan, err := t.planSequenceOwners(ctx)
+	if err != nil {
+		return nil, err
+	}
+	plan = append(plan, ownerPlan...)
+	// The foreign keys are added once all the columns exist, since a column can reference another column of the same table
+	for _, col := range t.Columns {
+		if col.Action == ActionDrop || skip[foreignKeyName(t.Name, col.Name)] {
+			continue
+		}
+		fkPlan, err := t.planForeignKey(ctx, col)
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, fkPlan...)
+	}
+	// Look for the columns that exist in the table but are no longer declared
+	if presence && (t.PruneMode == PruneWarn || t.PruneMode == PruneDrop) {
+		prunePlan, err := t.planPrune(ctx)
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, prunePlan...)
+	}
+	// Iterate over the available constraints --> the ones whose definition has changed are dropped first, and then added
+	for _, constraint := range t.constraints {
+		if skip[constraint.Name] {
+			continue
+		}
+		if err := constraint.validate(); err != nil {
+			return nil, &MigrationError{Table: t.Name, Constraint: constraint.Name, Step: StepAddConstraint, Err: err}
+		}
+		constraintPlan, err := t.planConstraint(ctx, constraint)
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, constraintPlan...)
+	}
+	// The indexes declared with AddIndex are planned last, once all the columns they cover exist
+	indexPlan, err := t.planIndexes(ctx, presence)
+	if err != nil {
+		return nil, err
+	}
+	plan = append(plan, indexPlan...)
+	if err := t.checkAddedLabels(plan, append(added, addedLabels(plan)...)); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// planConstraint returns the statements that add the constraint on the table if it doesn't exist, or drop and re-add it if its definition has changed. Nothing is returned if the constraint is unchanged
+func (t *Table) planConstraint(ctx context.Context, constraint Constraint) ([]PlannedStatement, error) {
+	presence, match, err := t.checkConstraintDefinition(ctx, constraint)
+	if err != nil {
+		return nil, err
+	}
+	if match {
+		return nil, nil
+	}
+	var plan []PlannedStatement
+	if presence {
+		dropRule := constraint.createDropRule(t.Name, t.DefaultSchema)
+		log.Debugln("Constraint drop rule is ", dropRule)
+		plan = append(plan, PlannedStatement{Table: t.Name, Constraint: constraint.Name, Step: StepDropConstraint, SQL: dropRule})
+	}
+	addRule := constraint.createAddRule(t.Name, t.DefaultSchema)
+	log.Debugln("Constraint add rule is ", addRule)
+	plan = append(plan, PlannedStatement{Table: t.Name, Constraint: constraint.Name, Step: StepAddConstraint, SQL: addRule})
+	return plan, nil
+}
+
+// planPrune returns the statements that drop the undeclared columns when PruneMode is PruneDrop. When PruneMode is PruneWarn, the undeclared columns are only logged
+func (t *Table) planPrune(ctx context.Context) ([]PlannedStatement, error) {
+	var plan []PlannedStatement
+	undeclared, err := t.UndeclaredColumns(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range undeclared {
+		if t.PruneMode == PruneWarn {
+			log.Warningln("Column --> ", name, " in table --> ", t.Name, " is not declared and can be dropped")
+			continue
+		}
+		col := Column{Name: name}
+		statement, err := col.prepareSQLStatement(StepDropColumn, t.Name, t.DefaultSchema, true)
+		if err != nil {
+			return nil, &MigrationError{Table: t.Name, Column: name, Step: StepDropColumn, Err: err}
+		}
+		plan = append(plan, PlannedStatement{Table: t.Name, Column: name, Step: StepDropColumn, SQL: statement})
+	}
+	return plan, nil
+}
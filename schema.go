@@ -0,0 +1,281 @@
+package schemamagic
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	pgx "github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// referencesPattern matches the (optionally schema qualified, optionally quoted) table that follows REFERENCES in a constraint
+var referencesPattern = regexp.MustCompile(`(?i)\bREFERENCES\s+((?:"(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*)(?:\s*\.\s*(?:"(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*))?)`)
+
+// Schema collects tables and applies all of them in a single transaction, ordered so that the tables referenced by foreign keys, and the tables that declare the enums used by other tables, are created before the tables referencing them
+type Schema struct {
+	Tx         pgx.Tx   // The transaction in which all the tables are applied. This replaces the Tx of every table
+	Autocommit bool     // Denotes if the transaction needs to be committed once all the tables have been applied
+	Tables     []*Table // Stores all the tables in this schema, in the order in which they were declared
+	// Denotes if an advisory lock needs to be held on every database and schema of the tables while migrating. The tables are planned once the lock is held, and the ones with nothing to change (such as the ones just migrated by another instance) are skipped
+	Lock        bool
+	LockTimeout time.Duration // Maximum time to wait for the lock. 0 waits until the context is done
+	DB          *pgxpool.Pool // Pool on which the statements that can't run inside a transaction are executed, for the tables that don't set their own DB
+}
+
+// deferredConstraint is a foreign key that is part of a cycle between tables, and is applied after all the tables have been applied.
+// column is set when the foreign key is declared through Column.References
+type deferredConstraint struct {
+	table      *Table
+	constraint Constraint
+	column     *Column
+}
+
+// plan returns the statements that apply the deferred foreign key
+func (d deferredConstraint) plan(ctx context.Context) ([]PlannedStatement, error) {
+	if d.column != nil {
+		return d.table.planForeignKey(ctx, *d.column)
+	}
+	return d.table.planConstraint(ctx, d.constraint)
+}
+
+// NewSchema creates and returns a collection of tables that are applied together
+func NewSchema(s Schema) *Schema {
+	schema := new(Schema)
+	schema.Tx = s.Tx
+	schema.Autocommit = s.Autocommit
+	schema.Tables = s.Tables
+	schema.Lock = s.Lock
+	schema.LockTimeout = s.LockTimeout
+	schema.DB = s.DB
+	return schema
+}
+
+// Append method accepts a table and appends it to the list of tables of the schema
+func (s *Schema) Append(table *Table) {
+	s.Tables = append(s.Tables, table)
+}
+
+// Begin applies all the tables in dependency order on the transaction of the schema, followed by the foreign keys that had to be deferred because of cycles.
+// The first failure is returned as a *MigrationError. The transaction is rolled back only if Autocommit is set. After the commit, the statements that can't run inside a transaction are executed by RunConcurrent
+func (s *Schema) Begin(ctx context.Context) error {
+	err := s.apply(ctx)
+	if s.Autocommit {
+		if err != nil {
+			s.Tx.Rollback(ctx)
+			return err
+		}
+		if commitErr := s.Tx.Commit(ctx); commitErr != nil {
+			s.Tx.Rollback(ctx)
+			log.Warningln("Couldn't commit changes to the schema with error being --> ", commitErr)
+			return &MigrationError{SQL: "COMMIT", Err: commitErr}
+		}
+		return s.RunConcurrent(ctx)
+	}
+	return err
+}
+
+// RunConcurrent executes the statements of the last Begin that can't run inside a transaction, table by table, in the order in which the tables were applied. It needs to be called after the transaction has been committed, which Begin does by itself when Autocommit is set
+func (s *Schema) RunConcurrent(ctx context.Context) error {
+	ordered, _ := s.order()
+	for _, table := range ordered {
+		if err := table.RunConcurrent(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply executes the plan of every table in dependency order, and then the deferred foreign keys
+func (s *Schema) apply(ctx context.Context) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	ordered, deferred := s.order()
+	// added stores the labels added to enums by the tables executed so far, which can't be used until the transaction is committed
+	var added []addedLabel
+	for _, table := range ordered {
+		log.Infoln("Operating on table --> ", table.Name)
+		s.prepareTable(table)
+		table.concurrent = nil
+		// The lock (if any) is already held, so the plan reflects the tables as migrated by the instances that held it before
+		plan, err := table.plan(ctx, deferredNames(table, deferred), added)
+		if err != nil {
+			return err
+		}
+		if !planChanges(plan) {
+			log.Infoln("Table --> ", table.Name, " is already in the declared state, skipping")
+			continue
+		}
+		if err := table.execute(ctx, plan); err != nil {
+			return err
+		}
+		added = append(added, addedLabels(plan)...)
+	}
+	for _, d := range deferred {
+		log.Infoln("Applying deferred constraint --> ", d.constraint.Name, " on table --> ", d.table.Name)
+		plan, err := d.plan(ctx)
+		if err != nil {
+			return err
+		}
+		if err := d.table.execute(ctx, plan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Plan returns the statements that Begin would execute for all the tables, in the order in which they would be executed, without executing any of them
+func (s *Schema) Plan(ctx context.Context) ([]PlannedStatement, error) {
+	var plan []PlannedStatement
+	ordered, deferred := s.order()
+	// The tables are planned on copies, so that the Tx, Autocommit and DB of the declared tables are left as they are
+	copies := make(map[*Table]*Table, len(ordered))
+	for _, table := range ordered {
+		planned := *table
+		s.prepareTable(&planned)
+		copies[table] = &planned
+		tablePlan, err := planned.plan(ctx, deferredNames(table, deferred), addedLabels(plan))
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, tablePlan...)
+	}
+	for _, d := range deferred {
+		d.table = copies[d.table]
+		deferredPlan, err := d.plan(ctx)
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, deferredPlan...)
+	}
+	return plan, nil
+}
+
+// prepareTable makes the table operate on the transaction of the schema
+func (s *Schema) prepareTable(table *Table) {
+	table.Tx = s.Tx
+	table.Autocommit = false
+	if table.DB == nil {
+		table.DB = s.DB
+	}
+}
+
+// order sorts the tables topologically on the foreign keys between them. Tables that do not depend on each other retain their declared order.
+// When the remaining tables form a cycle, the first of them in declared order is picked, and its foreign keys to the tables that are still pending are returned as deferred
+func (s *Schema) order() ([]*Table, []deferredConstraint) {
+	keys := make(map[string]*Table)
+	// enums stores the table that declares each enum
+	enums := make(map[string]*Table)
+	for _, table := range s.Tables {
+		keys[tableKey(table.DefaultSchema, table.Name)] = table
+		for _, enum := range table.enums {
+			enums[tableKey(enum.schema(table.DefaultSchema), enum.Name)] = table
+		}
+	}
+	// dependencies stores, for every table, the tables it references through each of its foreign keys (keyed by the constraint name), and the tables that declare the enums used by its columns
+	dependencies := make(map[*Table]map[string]*Table)
+	for _, table := range s.Tables {
+		dependencies[table] = make(map[string]*Table)
+		for _, col := range table.Columns {
+			if col.Action == ActionDrop {
+				continue
+			}
+			// The table that declares the enum used by the column needs to be applied first. The key is prefixed, so that it can't be mistaken for a foreign key
+			if typeKey, ok := enumReference(col.Datatype, table.DefaultSchema); ok {
+				if declaring, ok := enums[typeKey]; ok && declaring != table {
+					dependencies[table]["enum "+typeKey] = declaring
+				}
+			}
+			if col.References == nil {
+				continue
+			}
+			target := tableKey(col.References.referencedSchema(table.DefaultSchema), col.References.Table)
+			if referenced, ok := keys[target]; ok && referenced != table {
+				dependencies[table][foreignKeyName(table.Name, col.Name)] = referenced
+			}
+		}
+		for _, constraint := range table.constraints {
+			for _, target := range constraintReferences(constraint.Value, table.DefaultSchema) {
+				if referenced, ok := keys[target]; ok && referenced != table {
+					dependencies[table][constraint.Name] = referenced
+				}
+			}
+		}
+	}
+
+	var ordered []*Table
+	var deferred []deferredConstraint
+	placed := make(map[*Table]bool)
+	for len(ordered) < len(s.Tables) {
+		var next *Table
+		for _, table := range s.Tables {
+			if !placed[table] && dependenciesPlaced(dependencies[table], placed) {
+				next = table
+				break
+			}
+		}
+		if next == nil {
+			// There's a cycle --> break it at the first pending table
+			for _, table := range s.Tables {
+				if !placed[table] {
+					next = table
+					break
+				}
+			}
+			for i, col := range next.Columns {
+				name := foreignKeyName(next.Name, col.Name)
+				if referenced, ok := dependencies[next][name]; ok && !placed[referenced] {
+					log.Debugln("Deferring foreign key --> ", name, " on table --> ", next.Name, " since it is part of a cycle")
+					deferred = append(deferred, deferredConstraint{table: next, constraint: Constraint{Name: name}, column: &next.Columns[i]})
+				}
+			}
+			for _, constraint := range next.constraints {
+				if referenced, ok := dependencies[next][constraint.Name]; ok && !placed[referenced] {
+					log.Debugln("Deferring constraint --> ", constraint.Name, " on table --> ", next.Name, " since it is part of a cycle")
+					deferred = append(deferred, deferredConstraint{table: next, constraint: constraint})
+				}
+			}
+		}
+		placed[next] = true
+		ordered = append(ordered, next)
+	}
+	return ordered, deferred
+}
+
+// dependenciesPlaced returns if all the referenced tables have already been placed
+func dependenciesPlaced(referenced map[string]*Table, placed map[*Table]bool) bool {
+	for _, table := range referenced {
+		if !placed[table] {
+			return false
+		}
+	}
+	return true
+}
+
+// deferredNames returns the names of the deferred constraints that belong to the table
+func deferredNames(table *Table, deferred []deferredConstraint) map[string]bool {
+	names := make(map[string]bool)
+	for _, d := range deferred {
+		if d.table == table {
+			names[d.constraint.Name] = true
+		}
+	}
+	return names
+}
+
+// constraintReferences returns the schema qualified keys of the tables referenced in the constraint value. Quoted names are used as they are (even if they contain dots), unquoted names are folded to lower case, and unqualified tables are assumed to be in defaultSchema
+func constraintReferences(value string, defaultSchema string) []string {
+	var targets []string
+	for _, match := range referencesPattern.FindAllStringSubmatch(value, -1) {
+		if key, ok := qualifiedKey(match[1], defaultSchema); ok {
+			targets = append(targets, key)
+		}
+	}
+	return targets
+}
+
+// tableKey returns the key that identifies a table across schemas
+func tableKey(schema string, name string) string {
+	return schema + "." + name
+}
@@ -2,14 +2,128 @@ package schemamagic
 
 import (
 	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/stretchr/testify/require"
 	"github.com/twinj/uuid"
 )
 
+// fakeTx stands in for the transaction of a table in the tests that plan without a database. The queries are answered by query, which returns the rows (or an error), and the executed statements are collected
+type fakeTx struct {
+	pgx.Tx
+	query    func(sql string, args []any) ([][]any, error)
+	executed []string
+	args     [][]any
+}
+
+func (f *fakeTx) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	rows, err := f.answer(sql, args)
+	if err == nil && len(rows) == 0 {
+		err = pgx.ErrNoRows
+	}
+	row := &fakeRows{err: err}
+	if err == nil {
+		row.rows = rows[:1]
+	}
+	row.Next()
+	return row
+}
+
+func (f *fakeTx) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	rows, err := f.answer(sql, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{rows: rows}, nil
+}
+
+func (f *fakeTx) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	f.executed = append(f.executed, sql)
+	f.args = append(f.args, args)
+	return pgconn.CommandTag{}, nil
+}
+
+// answer returns the rows of the query, and fails on the queries that the test doesn't expect
+func (f *fakeTx) answer(sql string, args []any) ([][]any, error) {
+	if f.query != nil {
+		if rows, err := f.query(sql, args); rows != nil || err != nil {
+			return rows, err
+		}
+	}
+	return nil, fmt.Errorf("unexpected query %s with %v", sql, args)
+}
+
+// fakeRows returns canned rows, assigning each value to the destination of the same type
+type fakeRows struct {
+	pgx.Rows
+	rows    [][]any
+	current []any
+	err     error
+}
+
+func (r *fakeRows) Next() bool {
+	if r.err != nil || len(r.rows) == 0 {
+		return false
+	}
+	r.current, r.rows = r.rows[0], r.rows[1:]
+	return true
+}
+
+func (r *fakeRows) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	for i, d := range dest {
+		target := reflect.ValueOf(d).Elem()
+		if r.current[i] == nil {
+			target.SetZero()
+			continue
+		}
+		target.Set(reflect.ValueOf(r.current[i]))
+	}
+	return nil
+}
+
+func (r *fakeRows) Close()     {}
+func (r *fakeRows) Err() error { return r.err }
+
+// newFakeTable declares the table, in the public schema of the shop database unless the table sets them, on a fakeTx whose queries are answered by query
+func newFakeTable(table Table, query func(sql string, args []any) ([][]any, error)) (*Table, *fakeTx) {
+	tx := &fakeTx{query: query}
+	if table.DefaultSchema == "" {
+		table.DefaultSchema = "public"
+	}
+	if table.Database == "" {
+		table.Database = "shop"
+	}
+	table.Tx = tx
+	return NewTable(table), tx
+}
+
+// columnsAnswer answers checkColumnPresence with the columns that exist in the table
+func columnsAnswer(existing ...string) func(sql string, args []any) ([][]any, error) {
+	return func(sql string, args []any) ([][]any, error) {
+		if strings.Contains(sql, "INFORMATION_SCHEMA.COLUMNS WHERE table_name = $1 AND table_catalog = $2 AND column_name = $3") {
+			return [][]any{{slices.Contains(existing, args[2].(string))}}, nil
+		}
+		return nil, nil
+	}
+}
+
 func returnAllTables(tx pgx.Tx, schema string) []*Table {
 	tables := make([]*Table, 0)
 	tables = append(tables, tableTaxParams(tx, schema))
@@ -19,14 +133,14 @@ func returnAllTables(tx pgx.Tx, schema string) []*Table {
 
 // taxParam stores the info of every tax param in the tax_params DB table
 type taxParam struct {
-	ID                    int64   `json:"id"`
-	Name                  string  `json:"name"`
-	Description           string  `json:"description"`
-	TaxRatePercentage     float64 `json:"tax_rate_percentage"`
-	InputCreditPercentage float64 `json:"input_credit_percentage"`
-	AddedBy               string  `json:"added_by"`
-	Active                bool    `json:"active"`
-	Timestamp             int64   `json:"timestamp"`
+	ID                    int64   `json:"id" schemamagic:"datatype:bigserial;primary;sequence_restart:101"`
+	Name                  string  `json:"name" schemamagic:"unique"`
+	Description           string  `json:"description" schemamagic:"default:''"`
+	TaxRatePercentage     float64 `json:"tax_rate_percentage" schemamagic:"default:0.00"`
+	InputCreditPercentage float64 `json:"input_credit_percentage" schemamagic:"default:0.00"`
+	AddedBy               string  `json:"added_by" schemamagic:"default:''"`
+	Active                bool    `json:"active" schemamagic:"default:true"`
+	Timestamp             int64   `json:"timestamp" schemamagic:"default:date_part('epoch'::text, now())::bigint"`
 }
 
 func tableTaxParams(tx pgx.Tx, schema string) *Table {
@@ -114,7 +228,7 @@ func createTables(ctx context.Context, dbConn *pgxpool.Pool, schema string, asse
 			table.Append(NewColumn(Column{Name: "width_range", Datatype: "text[]", DefaultExists: true, DefaultValue: "'{}'"}))
 		}
 
-		table.Begin(ctx)
+		assert.Nil(table.Begin(ctx))
 
 	}
 	assert.Nil(tx.Commit(ctx))
@@ -125,7 +239,7 @@ func deleteTables(ctx context.Context, dbConn *pgxpool.Pool, schema string, asse
 	// Fetch the list of tables
 	tablesList := returnAllTables(tx, schema)
 	for _, table := range tablesList {
-		table.DropTable(ctx)
+		assert.Nil(table.DropTable(ctx))
 	}
 	assert.Nil(tx.Commit(ctx))
 }
@@ -237,6 +351,15 @@ func TestSchemamagic(t *testing.T) {
 
 	// Check if the newly entered column exists and has the default values set
 	allTables := returnAllTables(fetchTx(ctx, publicSchemaDBConn, assert), publicSchema)
+	// The tables already exist, so the plan must not try to create them again
+	for _, table := range allTables {
+		plan, err := table.Plan(ctx)
+		assert.Nil(err)
+		for _, statement := range plan {
+			assert.NotEqual(StepCreateTable, statement.Step)
+			assert.NotEqual(StepAddColumn, statement.Step)
+		}
+	}
 	for _, table := range allTables {
 		var widthRange []string
 		err = publicSchemaDBConn.QueryRow(ctx, `SELECT width_range FROM `+table.Name).Scan(&widthRange)
@@ -281,3 +404,1196 @@ func TestSchemamagic(t *testing.T) {
 	assert.Equal(section1.ID, section3.ID)
 	assert.Equal(section1.ID, section4.ID)
 }
+
+func TestSchemaOrder(t *testing.T) {
+	assert := require.New(t)
+	invoices := NewTable(Table{Name: "invoices", DefaultSchema: "public"})
+	invoices.AddConstraint(Constraint{Name: "invoices_client_fk", Value: "FOREIGN KEY (client_id) REFERENCES clients (id)"})
+	clients := NewTable(Table{Name: "clients", DefaultSchema: "public"})
+	clients.AddConstraint(Constraint{Name: "clients_region_fk", Value: "FOREIGN KEY (region_id) REFERENCES public.regions (id)"})
+	regions := NewTable(Table{Name: "regions", DefaultSchema: "public"})
+	// users and teams reference each other
+	users := NewTable(Table{Name: "users", DefaultSchema: "public"})
+	users.AddConstraint(Constraint{Name: "users_team_fk", Value: "FOREIGN KEY (team_id) REFERENCES teams (id)"})
+	teams := NewTable(Table{Name: "teams", DefaultSchema: "public"})
+	teams.AddConstraint(Constraint{Name: "teams_owner_fk", Value: "FOREIGN KEY (owner_id) REFERENCES users (id)"})
+	teams.AddConstraint(Constraint{Name: "teams_parent_fk", Value: "FOREIGN KEY (parent_id) REFERENCES teams (id)"})
+
+	// payments references invoices through a column
+	payments := NewTable(Table{Name: "payments", DefaultSchema: "public"})
+	payments.Append(NewColumn(Column{Name: "invoice_id", Datatype: "bigint", References: &ForeignKey{Table: "invoices", Column: "id", OnDelete: Cascade}}))
+
+	schema := NewSchema(Schema{Tables: []*Table{payments, invoices, clients, regions, users, teams}})
+	ordered, deferred := schema.order()
+	names := make([]string, 0, len(ordered))
+	for _, table := range ordered {
+		names = append(names, table.Name)
+	}
+	assert.Equal([]string{"regions", "clients", "invoices", "payments", "users", "teams"}, names)
+	assert.Len(deferred, 1)
+	assert.Equal("users", deferred[0].table.Name)
+	assert.Equal("users_team_fk", deferred[0].constraint.Name)
+}
+
+func TestGenerateSource(t *testing.T) {
+	assert := require.New(t)
+	table := NewTable(Table{Name: "tax_params", DefaultSchema: "public", Database: "schemamagic", Comment: "Tax rates"})
+	table.Append(NewColumn(Column{Name: "id", Datatype: "bigserial", IsPrimary: true}))
+	table.Append(NewColumn(Column{Name: "description", Datatype: "text", DefaultExists: true, DefaultValue: "''", Comment: "Shown on the invoice"}))
+	table.AddConstraint(Constraint{Name: "tax_rates", Value: "UNIQUE (tax_rate_percentage, input_credit_percentage)"})
+
+	source, err := GenerateSource("models", []*Table{table})
+	assert.Nil(err)
+	assert.Contains(string(source), "package models")
+	assert.Contains(string(source), "func tableTaxParams(tx pgx.Tx) *schemamagic.Table {")
+	assert.Contains(string(source), `table.Append(schemamagic.NewColumn(schemamagic.Column{Name: "id", Datatype: "bigserial", IsPrimary: true}))`)
+	assert.Contains(string(source), `schemamagic.NewTable(schemamagic.Table{Name: "tax_params", DefaultSchema: "public", Database: "schemamagic", Comment: "Tax rates", Tx: tx})`)
+	assert.Contains(string(source), `table.Append(schemamagic.NewColumn(schemamagic.Column{Name: "description", Datatype: "text", DefaultExists: true, DefaultValue: "''", Comment: "Shown on the invoice"}))`)
+	assert.Contains(string(source), `table.AddConstraint(schemamagic.Constraint{Name: "tax_rates", Value: "UNIQUE (tax_rate_percentage, input_credit_percentage)"})`)
+}
+
+func TestGenerateSourceCollidingNames(t *testing.T) {
+	assert := require.New(t)
+	var tables []*Table
+	for _, name := range []string{"a_b", "a-b", "a_b2", "Users", "users"} {
+		table := NewTable(Table{Name: name, DefaultSchema: "public", Database: "schemamagic"})
+		table.Append(NewColumn(Column{Name: "id", Datatype: "bigint"}))
+		tables = append(tables, table)
+	}
+
+	source, err := GenerateSource("models", tables)
+	assert.Nil(err)
+	file, err := parser.ParseFile(token.NewFileSet(), "models.go", source, 0)
+	assert.Nil(err)
+	var names []string
+	for _, decl := range file.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok {
+			names = append(names, fn.Name.Name)
+		}
+	}
+	assert.Equal([]string{"tableAB", "tableAB2", "tableAB22", "tableUsers", "tableUsers2"}, names)
+}
+
+func TestComments(t *testing.T) {
+	assert := require.New(t)
+	assert.Equal(`'it''s'`, quoteLiteral("it's"))
+	assert.Equal(`'a\b'`, quoteLiteral(`a\b`))
+
+	col := NewColumn(Column{Name: "description", Datatype: "text", Comment: "Shown on the invoice, isn't it"})
+	statement := `COMMENT ON COLUMN "public"."tax_params"."description" IS 'Shown on the invoice, isn''t it'`
+	tests := []struct {
+		name        string
+		col         Column
+		presence    bool
+		description string
+		expected    []string
+	}{
+		{"unchanged", col, true, "Shown on the invoice, isn't it", nil},
+		{"changed", col, true, "Shown on the bill", []string{statement}},
+		{"set by hand", col, true, "", []string{statement}},
+		{"new column", col, false, "", []string{statement}},
+		// Comments set by hand are left alone when none is declared
+		{"not declared", NewColumn(Column{Name: "description", Datatype: "text"}), true, "Set by hand", nil},
+	}
+	for _, test := range tests {
+		table, _ := newFakeTable(Table{Name: "tax_params"}, func(sql string, args []any) ([][]any, error) {
+			if strings.Contains(sql, "col_description") {
+				return [][]any{{test.description}}, nil
+			}
+			return nil, nil
+		})
+		plan, err := table.planColumnComment(context.Background(), test.col, test.col.Name, test.presence)
+		assert.NoError(err, test.name)
+		var statements []string
+		for _, p := range plan {
+			assert.Equal(StepComment, p.Step)
+			statements = append(statements, p.SQL)
+		}
+		assert.Equal(test.expected, statements, test.name)
+	}
+
+	// The same applies to the comment of the table
+	for description, expected := range map[string]int{"Tax rates": 0, "Rates": 1} {
+		table, _ := newFakeTable(Table{Name: "tax_params", Comment: "Tax rates"}, func(sql string, args []any) ([][]any, error) {
+			return [][]any{{description}}, nil
+		})
+		plan, err := table.planTableComment(context.Background(), true)
+		assert.NoError(err)
+		assert.Len(plan, expected, description)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	assert := require.New(t)
+	tables, err := Load(strings.NewReader(`
+database: schemamagic
+schema: public
+tables:
+  - name: forms_sections
+    prune_mode: warn
+    columns:
+      - name: id
+        datatype: bigserial
+        is_primary: true
+      - name: type
+        datatype: text
+        is_not_null: true
+        default_exists: true
+        default_value: "''"
+        index_required: true
+    constraints:
+      - name: forms_sections_type_name
+        value: UNIQUE (type, name)
+`))
+	assert.Nil(err)
+	assert.Len(tables, 1)
+	assert.Equal("forms_sections", tables[0].Name)
+	assert.Equal("public", tables[0].DefaultSchema)
+	assert.Equal("schemamagic", tables[0].Database)
+	assert.Equal(PruneWarn, tables[0].PruneMode)
+	assert.Equal(NewColumn(Column{Name: "id", Datatype: "bigserial", IsPrimary: true}), tables[0].Columns[0])
+	assert.Equal(NewColumn(Column{Name: "type", Datatype: "text", IsNotNull: true, DefaultExists: true, DefaultValue: "''", IndexRequired: true}), tables[0].Columns[1])
+	assert.Equal([]Constraint{{Name: "forms_sections_type_name", Value: "UNIQUE (type, name)"}}, tables[0].constraints)
+
+	// JSON is accepted as well
+	tables, err = Load(strings.NewReader(`{"tables": [{"name": "tax_params", "columns": [{"name": "id", "datatype": "bigserial"}]}]}`))
+	assert.Nil(err)
+	assert.Equal("tax_params", tables[0].Name)
+
+	// Unknown keys, bad types and missing datatypes are reported with their line numbers
+	_, err = Load(strings.NewReader("tables:\n  - name: t\n    columns:\n      - name: id\n        datatyp: text\n"))
+	assert.ErrorContains(err, "line 5")
+	_, err = Load(strings.NewReader("tables:\n  - name: t\n    columns:\n      - name: id\n        datatype: text\n        is_unique: maybe\n"))
+	assert.ErrorContains(err, "line 6")
+	_, err = Load(strings.NewReader("tables:\n  - name: t\n    columns:\n      - name: id\n"))
+	assert.ErrorContains(err, "line 4: column id in table t has an empty datatype")
+}
+
+func TestNewTableFromStruct(t *testing.T) {
+	assert := require.New(t)
+	// The tags on taxParam declare the same columns as tableTaxParams
+	table, err := NewTableFromStruct(Table{Name: "tax_params", DefaultSchema: "public", Database: "schemamagic"}, taxParam{})
+	assert.Nil(err)
+	assert.Equal("tax_params", table.Name)
+	assert.Equal(tableTaxParams(nil, "public").Columns, table.Columns)
+
+	type embedded struct {
+		CreatedAt time.Time `schemamagic:"default:now();notnull"`
+	}
+	type model struct {
+		embedded
+		HTTPStatus int32
+		Tags       []string        `schemamagic:"index_type:gin"`
+		Payload    json.RawMessage `json:"payload,omitempty"`
+		Ignored    string          `schemamagic:"-"`
+		Channel    chan int        `schemamagic:"name:channel_id;datatype:uuid"`
+	}
+	table, err = NewTableFromStruct(Table{Name: "models"}, &model{})
+	assert.Nil(err)
+	assert.Equal([]Column{
+		NewColumn(Column{Name: "created_at", Datatype: "timestamp with time zone", DefaultExists: true, DefaultValue: "now()", IsNotNull: true}),
+		NewColumn(Column{Name: "http_status", Datatype: "integer"}),
+		NewColumn(Column{Name: "tags", Datatype: "text[]", IndexRequired: true, IndexType: "gin"}),
+		NewColumn(Column{Name: "payload", Datatype: "jsonb"}),
+		NewColumn(Column{Name: "channel_id", Datatype: "uuid"}),
+	}, table.Columns)
+
+	_, err = NewTableFromStruct(Table{Name: "models"}, struct{ C chan int }{})
+	assert.NotNil(err)
+	_, err = NewTableFromStruct(Table{Name: "models"}, struct {
+		A string `schemamagic:"uniq"`
+	}{})
+	assert.ErrorContains(err, "unknown option")
+}
+
+func TestIdentifiers(t *testing.T) {
+	assert := require.New(t)
+	col := NewColumn(Column{Name: "order", Datatype: "bigint", IsUnique: true, IndexRequired: true})
+	statement, err := col.prepareSQLStatement(StepAddColumn, "Invoices", "public", false)
+	assert.Nil(err)
+	assert.Equal(`ALTER TABLE "public"."Invoices" ADD "order" bigint`, statement)
+	statement, err = col.prepareSQLStatement(StepIndex, "Invoices", "public", false)
+	assert.Nil(err)
+	assert.Equal(`CREATE INDEX IF NOT EXISTS "Invoices_order_index" ON "public"."Invoices" ("order")`, statement)
+
+	table := NewTable(Table{Name: "invoices", DefaultSchema: "public"})
+	table.Append(NewColumn(Column{Name: strings.Repeat("a", 64), Datatype: "text"}))
+	assert.ErrorContains(table.validate(), "longer than the maximum of 63")
+	table = NewTable(Table{Name: "", DefaultSchema: "public"})
+	assert.ErrorContains(table.validate(), "table name is empty")
+}
+
+func TestForeignKeyConstraint(t *testing.T) {
+	assert := require.New(t)
+	fk := &ForeignKey{Table: "invoices", Column: "id", OnDelete: "cascade", Deferrable: true, InitiallyDeferred: true}
+	assert.Nil(fk.validate())
+	constraint := fk.constraint("payments", "billing", "invoice_id")
+	assert.Equal("payments_invoice_id_fkey", constraint.Name)
+	assert.Equal(`FOREIGN KEY ("invoice_id") REFERENCES "billing"."invoices" ("id") ON DELETE CASCADE ON UPDATE NO ACTION DEFERRABLE INITIALLY DEFERRED`, constraint.Value)
+
+	assert.NotNil((&ForeignKey{Table: "invoices", Column: "id", OnUpdate: "explode"}).validate())
+	assert.NotNil((&ForeignKey{Table: "invoices", Column: "id", InitiallyDeferred: true}).validate())
+	assert.NotNil((&ForeignKey{Column: "id"}).validate())
+}
+
+func TestNormalizeConstraintDefinition(t *testing.T) {
+	assert := require.New(t)
+	cases := []struct {
+		declared string
+		defined  string
+		match    bool
+	}{
+		{`UNIQUE ("created_at", "version_new")`, `UNIQUE (created_at, version_new)`, true},
+		{`PRIMARY KEY (action,  version_description)`, `PRIMARY KEY (action, version_description)`, true},
+		{`FOREIGN KEY (user_id) REFERENCES public.users (id) ON DELETE NO ACTION`, `FOREIGN KEY (user_id) REFERENCES users(id)`, true},
+		{`FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE`, `FOREIGN KEY (user_id) REFERENCES users(id)`, false},
+		{`UNIQUE (created_at)`, `UNIQUE (created_at, version_new)`, false},
+		// Literals and quoted identifiers are compared as they are
+		{`CHECK (status IN ('Active', 'Closed'))`, `CHECK (status IN ('active', 'closed'))`, false},
+		{`CHECK (Status  IN ('Active',  'a  b'))`, `CHECK (status IN ('Active', 'a  b'))`, true},
+		{`CHECK (note <> 'public.x')`, `CHECK (note <> 'x')`, false},
+		{`CHECK (note <> 'it''s "Quoted"')`, `CHECK (note <> 'it''s "quoted"')`, false},
+		{`CHECK ("Status" <> '')`, `CHECK (status <> '')`, false},
+		{`CHECK ("Status" <> '')`, `CHECK ("Status" <> '')`, true},
+		{`FOREIGN KEY ("user_id") REFERENCES "public"."users" ("id")`, `FOREIGN KEY (user_id) REFERENCES users(id)`, true},
+		// Definitions as printed by pg_get_constraintdef, with casts and redundant parentheses
+		{`CHECK (name <> '')`, `CHECK ((name <> ''::text))`, true},
+		{`CHECK (name <> 'Draft')`, `CHECK ((name <> 'draft'::text))`, false},
+		{`CHECK (price > 0)`, `CHECK ((price > (0)::numeric))`, true},
+		{`CHECK (amount > -1)`, `CHECK ((amount > '-1'::integer))`, true},
+		{`CHECK (created_at <= now())`, `CHECK ((created_at <= now()))`, true},
+		{`CHECK (status = ANY (ARRAY['draft', 'paid']))`, `CHECK ((status = ANY (ARRAY['draft'::text, 'paid'::text])))`, true},
+		{`CHECK (name::text <> '')`, `CHECK (((name)::text <> ''::text))`, true},
+		{`CHECK (char_length(code) = 3)`, `CHECK ((char_length((code)::text) = 3))`, true},
+		{`CHECK (price > 0)`, `CHECK ((price > (1)::numeric))`, false},
+		{`UNIQUE (email, tenant_id)`, `UNIQUE (email, tenant_id)`, true},
+		{`UNIQUE (tenant_id, email)`, `UNIQUE (email, tenant_id)`, false},
+		{`FOREIGN KEY (client_id) REFERENCES billing.clients (id) ON DELETE CASCADE`, `FOREIGN KEY (client_id) REFERENCES billing.clients(id) ON DELETE CASCADE`, true},
+		{`FOREIGN KEY (client_id) REFERENCES clients (id)`, `FOREIGN KEY (client_id) REFERENCES billing.clients(id)`, false},
+		{`FOREIGN KEY (user_id) REFERENCES users (id) ON UPDATE NO ACTION ON DELETE SET NULL`, `FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL`, true},
+		// Index definitions as printed by pg_get_indexdef
+		{`CREATE INDEX "users_email" ON "public"."users" USING btree ((lower(email)))`, `CREATE INDEX users_email ON public.users USING btree (lower((email)::text))`, true},
+		{`CREATE INDEX "users_point" ON "public"."users" USING gist ((point(x, y)))`, `CREATE INDEX users_point ON public.users USING gist (point(x, y))`, true},
+	}
+	for _, c := range cases {
+		match := normalizeConstraintDefinition(c.declared, "public") == normalizeConstraintDefinition(c.defined, "public")
+		assert.Equal(c.match, match, "%s <> %s", c.declared, c.defined)
+	}
+}
+
+func TestConcurrentIndex(t *testing.T) {
+	assert := require.New(t)
+	col := NewColumn(Column{Name: "created_at", Datatype: "bigint", IndexRequired: true, IndexConcurrently: true})
+	statement, err := col.prepareSQLStatement(StepIndex, "orders", "public", true)
+	assert.NoError(err)
+	assert.Equal(`CREATE INDEX CONCURRENTLY IF NOT EXISTS "orders_created_at_index" ON "public"."orders" ("created_at")`, statement)
+
+	planned := PlannedStatement{Table: "orders", Column: "created_at", Step: StepIndex, SQL: statement, Concurrent: true}
+	assert.True(strings.HasPrefix(planned.String(), "-- orders.created_at, step 8, after commit\n"))
+
+	assert.Equal("btree", col.indexMethod())
+	tags := NewColumn(Column{Name: "tags", Datatype: "text[]", IndexRequired: true, IndexType: "GIN"})
+	assert.Equal("gin", tags.indexMethod())
+
+	// The option has no effect without an index
+	assert.False(NewColumn(Column{Name: "id", Datatype: "bigint", IndexConcurrently: true}).IndexConcurrently)
+}
+
+func TestConcurrentWithoutDB(t *testing.T) {
+	assert := require.New(t)
+	table, tx := newFakeTable(Table{Name: "orders"}, nil)
+	plan := []PlannedStatement{
+		{Table: "orders", Column: "created_at", Step: StepAddColumn, SQL: `ALTER TABLE "public"."orders" ADD COLUMN "created_at" bigint`},
+		{Table: "orders", Column: "created_at", Index: "orders_created_at_index", Step: StepIndex, SQL: `CREATE INDEX CONCURRENTLY IF NOT EXISTS "orders_created_at_index" ON "public"."orders" ("created_at")`, Concurrent: true},
+	}
+	// Nothing is executed, instead of failing after the commit
+	err := table.execute(context.Background(), plan)
+	assert.ErrorIs(err, ErrNoDB)
+	var migrationErr *MigrationError
+	assert.ErrorAs(err, &migrationErr)
+	assert.Equal(StepIndex, migrationErr.Step)
+	assert.Empty(tx.executed)
+	assert.Empty(table.concurrent)
+
+	assert.NoError(table.execute(context.Background(), plan[:1]))
+	assert.Len(tx.executed, 1)
+}
+
+func TestIndex(t *testing.T) {
+	assert := require.New(t)
+	index := Index{
+		Name:    "users_email_active",
+		Columns: []IndexColumn{{Expression: "lower(email)"}, {Name: "created_at", Descending: true, Nulls: "last"}},
+		Unique:  true,
+		Include: []string{"name"},
+		Where:   "deleted_at IS NULL",
+	}
+	assert.NoError(index.validate())
+	assert.Equal(`CREATE UNIQUE INDEX "users_email_active" ON "public"."users" USING btree ((lower(email)), "created_at" DESC NULLS LAST) INCLUDE ("name") WHERE deleted_at IS NULL`, index.createStatement("users", "public"))
+
+	// Building the index concurrently doesn't change its definition
+	concurrent := index
+	concurrent.Concurrently = true
+	assert.Equal(index.definition("users", "public"), concurrent.definition("users", "public"))
+	assert.True(strings.HasPrefix(concurrent.createStatement("users", "public"), "CREATE UNIQUE INDEX CONCURRENTLY "))
+
+	// An index created by hand is adopted (recorded, without touching its comment) if its definition matches
+	table := NewTable(Table{Name: "users", DefaultSchema: "public"})
+	plain := Index{Name: "users_name", Columns: []IndexColumn{{Name: "name"}}}
+	existing := map[string]existingIndex{"users_name": {definition: "CREATE INDEX users_name ON public.users USING btree (name)", valid: true, comment: "Added by the DBA"}}
+	plan := table.planIndex(plain, existing)
+	assert.Len(plan, 1)
+	assert.Equal(`INSERT INTO "public"."schemamagic_indexes" (table_name, index_name, definition, concurrently) VALUES ('users', 'users_name', 'CREATE INDEX "users_name" ON "public"."users" USING btree ("name")', false) ON CONFLICT (table_name, index_name) DO UPDATE SET definition = EXCLUDED.definition, concurrently = EXCLUDED.concurrently`, plan[0].SQL)
+
+	assert.Error((&Index{Name: "empty"}).validate())
+	assert.Error((&Index{Name: "both", Columns: []IndexColumn{{Name: "a", Expression: "lower(a)"}}}).validate())
+	assert.Error((&Index{Name: "method", Columns: []IndexColumn{{Name: "a"}}, Method: "btree; DROP TABLE users"}).validate())
+}
+
+func TestPlanIndexes(t *testing.T) {
+	assert := require.New(t)
+	email := Index{Name: "users_email", Columns: []IndexColumn{{Expression: "lower(email)"}}}
+	tests := []struct {
+		name     string
+		indexes  []Index
+		records  [][]any
+		expected []string
+	}{
+		// The recorded definition is compared, since pg_get_indexdef rewrites expressions
+		{"unchanged", []Index{email}, [][]any{{"users_email", email.definition("users", "public"), false}}, nil},
+		{"changed", []Index{{Name: "users_email", Columns: []IndexColumn{{Expression: "upper(email)"}}}}, [][]any{{"users_email", email.definition("users", "public"), false}}, []string{
+			`DROP INDEX IF EXISTS "public"."users_email"`,
+			`CREATE INDEX "users_email" ON "public"."users" USING btree ((upper(email)))`,
+			"INSERT INTO",
+		}},
+		// An undeclared index is dropped the way it was built, and only if it was created through AddIndex
+		{"undeclared", nil, [][]any{{"users_email", email.definition("users", "public"), true}}, []string{
+			`DROP INDEX CONCURRENTLY IF EXISTS "public"."users_email"`,
+			`DELETE FROM "public"."schemamagic_indexes" WHERE table_name = 'users' AND index_name = 'users_email'`,
+		}},
+		{"created by hand", nil, [][]any{}, nil},
+	}
+	for _, test := range tests {
+		table, _ := newFakeTable(Table{Name: "users"}, func(sql string, args []any) ([][]any, error) {
+			switch {
+			case strings.Contains(sql, "pg_catalog.pg_index"):
+				return [][]any{{"users_email", "CREATE INDEX users_email ON public.users USING btree (lower((email)::text))", "btree", true, "Added by the DBA"}}, nil
+			case strings.Contains(sql, "to_regclass"):
+				return [][]any{{true}}, nil
+			case strings.Contains(sql, "schemamagic_indexes"):
+				return test.records, nil
+			}
+			return nil, nil
+		})
+		for _, index := range test.indexes {
+			table.AddIndex(index)
+		}
+		plan, err := table.planIndexes(context.Background(), true)
+		assert.NoError(err, test.name)
+		assert.Len(plan, len(test.expected), test.name)
+		for i, statement := range plan {
+			assert.True(strings.HasPrefix(statement.SQL, test.expected[i]), "%s: %s", test.name, statement.SQL)
+			assert.NotContains(statement.SQL, "COMMENT ON", test.name)
+		}
+		if test.name == "undeclared" {
+			assert.True(plan[0].Concurrent && plan[1].Concurrent)
+		}
+	}
+}
+
+func TestDefaultChanged(t *testing.T) {
+	assert := require.New(t)
+	tests := []struct {
+		stored   string
+		declared string
+		changed  bool
+	}{
+		{"'active'::text", "'active'", false},
+		{"'active'::character varying", "'active'", false},
+		{"'active'::text", "'Active'", true},
+		{"'-1'::integer", "-1", false},
+		{"0", "0", false},
+		{"0.00", "0", true},
+		{"now()", "NOW()", false},
+		{"CURRENT_TIMESTAMP", "current_timestamp", false},
+		{"(date_part('epoch'::text, now()))::bigint", "date_part('epoch', now())::bigint", false},
+		{"nextval('users_id_seq'::regclass)", "nextval('users_id_seq')", false},
+		{"'{}'::text[]", "'{}'", false},
+		{"'2024-01-01 00:00:00+00'::timestamp with time zone", "'2024-01-01 00:00:00+00'", false},
+		{"(1 + 2)", "1+2", false},
+		{"((price * 2) + 1)", "(price * 2) + (1)", false},
+		// The parentheses that PostgreSQL adds for the precedence of the operators aren't understood
+		{"((price * 2) + 1)", "price * 2 + 1", true},
+		{"'a::b'::text", "'a::b'", false},
+		{"", "0", true},
+	}
+	table := NewTable(Table{Name: "users", DefaultSchema: "public"})
+	for _, test := range tests {
+		// Nothing is executed (or queried) to compare the defaults
+		col := NewColumn(Column{Name: "status", Datatype: "text", DefaultExists: true, DefaultValue: test.declared})
+		assert.Equal(test.changed, table.defaultChanged(col, columnState{defaultValue: test.stored}), "%s <> %s", test.stored, test.declared)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	assert := require.New(t)
+	col := NewColumn(Column{Name: "status", Datatype: "text", DefaultExists: true, DefaultValue: "'active'", Backfill: BackfillNulls, BackfillBatchSize: 500})
+	assert.NoError(col.validateBackfill())
+
+	added, err := col.prepareSQLStatement(StepAddColumn, "users", "public", false)
+	assert.NoError(err)
+	assert.Equal(`ALTER TABLE "public"."users" ADD "status" text DEFAULT 'active'`, added)
+
+	backfill, err := col.prepareSQLStatement(StepBackfillDefault, "users", "public", true)
+	assert.NoError(err)
+	assert.Equal(`UPDATE "public"."users" SET "status" = 'active' WHERE "status" IS NULL`, backfill)
+
+	batch := col.batchedBackfill("users", "public", "id")
+	assert.Contains(batch.first, `WHERE "status" IS NULL ORDER BY "id" LIMIT 500`)
+	assert.Contains(batch.next, `WHERE "status" IS NULL AND "id" > $1 ORDER BY "id" LIMIT 500`)
+
+	assert.Error((&Column{Backfill: "some"}).validateBackfill())
+
+	// The rows are only counted for NULLs when they aren't filled before NOT NULL is set
+	changed := []int{StepSetDefault, StepBackfillDefault, StepNotNull}
+	tests := []struct {
+		name     string
+		col      Column
+		presence bool
+		steps    []int
+		filled   bool
+	}{
+		{"added with a default", Column{DefaultExists: true}, false, nil, true},
+		{"added without a default", Column{}, false, nil, false},
+		{"added as identity", Column{Identity: IdentityAlways}, false, nil, true},
+		{"backfilled", Column{DefaultExists: true, Backfill: BackfillNulls}, true, changed, true},
+		{"default unchanged", Column{DefaultExists: true, Backfill: BackfillNulls}, true, []int{StepNotNull}, false},
+		{"never backfilled", Column{DefaultExists: true}, true, changed, false},
+		// A batched backfill runs after the commit, while SET NOT NULL runs in the transaction
+		{"batched", Column{DefaultExists: true, Backfill: BackfillNulls, BackfillBatchSize: 500}, true, changed, false},
+		{"batched with SafeNotNull", Column{DefaultExists: true, Backfill: BackfillNulls, BackfillBatchSize: 500, SafeNotNull: true}, true, changed, true},
+	}
+	for _, test := range tests {
+		assert.Equal(test.filled, test.col.filledBeforeNotNull(test.presence, test.steps), test.name)
+	}
+}
+
+func TestSafeNotNull(t *testing.T) {
+	assert := require.New(t)
+	table := NewTable(Table{Name: "users", DefaultSchema: "public"})
+	col := NewColumn(Column{Name: "email", Datatype: "text", IsNotNull: true, SafeNotNull: true})
+	// The rows are filled with the default, so they are not counted
+	plan, err := table.planNotNull(context.Background(), col, col.Name, true, false, true)
+	assert.NoError(err)
+	assert.Len(plan, 5)
+	assert.Equal(`ALTER TABLE "public"."users" ADD CONSTRAINT "users_email_not_null" CHECK ("email" IS NOT NULL) NOT VALID`, plan[1].SQL)
+	assert.Equal(`ALTER TABLE "public"."users" VALIDATE CONSTRAINT "users_email_not_null"`, plan[2].SQL)
+	assert.Equal(`ALTER TABLE "public"."users" ALTER COLUMN "email" SET NOT NULL`, plan[3].SQL)
+	for _, statement := range plan {
+		assert.True(statement.Concurrent)
+	}
+
+	// Nothing is planned when the column is already NOT NULL
+	plan, err = table.planNotNull(context.Background(), col, col.Name, true, true, false)
+	assert.NoError(err)
+	assert.Empty(plan)
+
+	assert.False(NewColumn(Column{Name: "email", Datatype: "text", SafeNotNull: true}).SafeNotNull)
+}
+
+func TestClassifyTypmodChange(t *testing.T) {
+	assert := require.New(t)
+	varchar := func(length int32) datatype { return datatype{oid: 1043, typmod: length + 4} }
+	numeric := func(precision int32, scale int32) datatype {
+		return datatype{oid: numericOID, typmod: precision<<16 | scale + 4}
+	}
+	unlimited := datatype{oid: 1043, typmod: -1}
+	assert.Equal(TypeChangeNone, classifyTypmodChange(varchar(20), varchar(20)))
+	assert.Equal(TypeChangeWidening, classifyTypmodChange(varchar(20), varchar(50)))
+	assert.Equal(TypeChangeWidening, classifyTypmodChange(varchar(20), unlimited))
+	assert.Equal(TypeChangeNarrowing, classifyTypmodChange(varchar(50), varchar(20)))
+	assert.Equal(TypeChangeNarrowing, classifyTypmodChange(unlimited, varchar(20)))
+	assert.Equal(TypeChangeWidening, classifyTypmodChange(numeric(10, 2), numeric(12, 2)))
+	assert.Equal(TypeChangeNarrowing, classifyTypmodChange(numeric(10, 2), numeric(12, 4)))
+	// Only varchar, varbit, numeric and the precision of timestamp and time can be relaxed without touching the rows
+	tests := []struct {
+		oid   uint32
+		from  int32
+		to    int32
+		class string
+	}{
+		{varbitOID, 8, 16, TypeChangeWidening},
+		{varbitOID, 16, 8, TypeChangeNarrowing},
+		{timestamptzOID, 0, 3, TypeChangeWidening},
+		{timestampOID, 3, -1, TypeChangeWidening},
+		{timeOID, 6, 3, TypeChangeNarrowing},
+		{timetzOID, -1, 3, TypeChangeNarrowing},
+		{numericOID, -1, 10<<16 | 2 + 4, TypeChangeNarrowing},
+		{numericOID, 10<<16 | 2 + 4, -1, TypeChangeWidening},
+		{bpcharOID, 5, 10, TypeChangeRewrite},
+		{bpcharOID, 10, 5, TypeChangeNarrowing},
+		{1560, 8, 16, TypeChangeNarrowing},          // bit(n) values need to be of exactly the length
+		{1560, 8, -1, TypeChangeNarrowing},          // bit without a length is bit(1)
+		{1186, 0x7fff0000, -1, TypeChangeNarrowing}, // interval fields and precision
+	}
+	for _, test := range tests {
+		assert.Equal(test.class, classifyTypmodChange(datatype{oid: test.oid, typmod: test.from}, datatype{oid: test.oid, typmod: test.to}), "%d: %d --> %d", test.oid, test.from, test.to)
+	}
+	assert.True(safeTypeChange(TypeChangeBinaryCoercible))
+	assert.False(safeTypeChange(TypeChangeRewrite))
+
+	col := NewColumn(Column{Name: "created_at", Datatype: "timestamptz", Using: "to_timestamp(created_at)"})
+	statement, err := col.prepareSQLStatement(StepAlterDatatype, "users", "public", true)
+	assert.NoError(err)
+	assert.Equal(`ALTER TABLE "public"."users" ALTER COLUMN "created_at" TYPE timestamptz USING to_timestamp(created_at)`, statement)
+}
+
+func TestIdentity(t *testing.T) {
+	assert := require.New(t)
+	col := NewColumn(Column{Name: "id", Datatype: "bigint", Identity: "by  default", IdentityStart: 1000})
+	assert.NoError(col.validateIdentity())
+	added, err := col.prepareSQLStatement(StepAddColumn, "orders", "public", false)
+	assert.NoError(err)
+	assert.Equal(`ALTER TABLE "public"."orders" ADD "id" bigint GENERATED BY DEFAULT AS IDENTITY (START WITH 1000)`, added)
+
+	conversion := col.identityConversion("orders", "public", true)
+	assert.Contains(conversion, `pg_get_serial_sequence('"public"."orders"', 'id')`)
+	assert.Contains(conversion, `ADD GENERATED BY DEFAULT AS IDENTITY (START WITH %s)', greatest(next_value, 1000))`)
+
+	// A nullable column is only converted if it has no NULLs, since the conversion sets NOT NULL
+	for _, test := range []struct {
+		state columnState
+		nulls int64
+		err   error
+	}{
+		{columnState{}, 3, ErrNullValues},
+		{columnState{}, 0, nil},
+		{columnState{notNull: true}, 3, nil},
+	} {
+		var counted bool
+		table, _ := newFakeTable(Table{Name: "orders"}, func(sql string, args []any) ([][]any, error) {
+			if strings.Contains(sql, "count(*)") {
+				counted = true
+				return [][]any{{test.nulls}}, nil
+			}
+			return nil, nil
+		})
+		plan, err := table.planIdentity(context.Background(), NewColumn(Column{Name: "id", Datatype: "bigint", Identity: IdentityAlways}), "id", test.state)
+		assert.Equal(!test.state.notNull, counted)
+		if test.err != nil {
+			assert.ErrorIs(err, test.err)
+			assert.Empty(plan)
+			continue
+		}
+		assert.NoError(err)
+		assert.Len(plan, 1)
+		assert.Contains(plan[0].SQL, "SELECT coalesce(max(\"id\"), 0) + 1")
+	}
+
+	assert.Error((&Column{Name: "id", Datatype: "bigserial", Identity: IdentityAlways}).validateIdentity())
+	assert.Error((&Column{Name: "id", Datatype: "bigint", Identity: "sometimes"}).validateIdentity())
+}
+
+func TestSequenceRestart(t *testing.T) {
+	assert := require.New(t)
+	col := NewColumn(Column{Name: "id", Datatype: "bigserial"})
+	assert.Zero(col.SequenceRestart)
+	restart, err := col.prepareSQLStatement(StepRestartSequence, "orders", "sales", false)
+	assert.NoError(err)
+	assert.Empty(restart)
+
+	col = NewColumn(Column{Name: "id", Datatype: "bigserial", SequenceRestart: 500})
+	restart, err = col.prepareSQLStatement(StepRestartSequence, "orders", "sales", false)
+	assert.NoError(err)
+	assert.Equal(`SELECT setval(pg_get_serial_sequence('"sales"."orders"', 'id'), 500, false)`, restart)
+	restart, err = col.prepareSQLStatement(StepRestartSequence, "orders", "sales", true)
+	assert.NoError(err)
+	assert.Empty(restart)
+
+	col.SequenceRestartIfLower = true
+	restart, err = col.prepareSQLStatement(StepRestartSequence, "orders", "sales", true)
+	assert.NoError(err)
+	assert.Contains(restart, `WHERE (SELECT coalesce(pg_sequence_last_value(s.seqrelid) + s.seqincrement, s.seqstart) FROM pg_catalog.pg_sequence s WHERE s.seqrelid = pg_get_serial_sequence('"sales"."orders"', 'id')::regclass) < 500`)
+
+	col = NewColumn(Column{Name: "id", Datatype: "bigint", Identity: IdentityAlways, SequenceMax: 1000000, SequenceCache: 10})
+	assert.NoError(col.validateSequence())
+	assert.Equal("MAXVALUE 1000000 CACHE 10 NO CYCLE", col.sequenceOptions())
+	assert.Error((&Column{Name: "code", Datatype: "text", SequenceCache: 10}).validateSequence())
+	assert.Error((&Column{Name: "id", Datatype: "serial", SequenceMin: 10, SequenceMax: 5}).validateSequence())
+}
+
+func TestSequence(t *testing.T) {
+	assert := require.New(t)
+	sequence := Sequence{Name: "invoice_number", Start: 1000, Increment: 1, Cache: 10}
+	assert.NoError(sequence.validate())
+	assert.Equal([]string{"INCREMENT BY 1", "START WITH 1000", "CACHE 10"}, sequence.options(nil))
+	// Only the options that differ from the existing sequence are altered
+	existing := &existingSequence{start: 1000, increment: 1, min: 1, max: 9223372036854775807, cache: 1, cycle: true}
+	assert.Equal([]string{"CACHE 10", "NO CYCLE"}, sequence.options(existing))
+	existing.cache, existing.cycle = 10, false
+	assert.Empty(sequence.options(existing))
+
+	assert.Equal("billing", (&Sequence{Name: "invoice_number"}).schema("billing"))
+	assert.Error((&Sequence{Name: "invoice_number", Min: 10, Max: 5}).validate())
+
+	table := NewTable(Table{Name: "invoices", DefaultSchema: "billing"})
+	table.Append(NewColumn(Column{Name: "number", Datatype: "bigint"}))
+	table.AddSequence(Sequence{Name: "invoice_number", OwnedBy: "num"})
+	assert.ErrorContains(table.validate(), "column num, which is not declared")
+
+	tables, err := Load(strings.NewReader("tables:\n  - name: invoices\n    columns:\n      - name: number\n        datatype: bigint\n    sequences:\n      - name: invoice_number\n        start: 1000\n        owned_by: number\n"))
+	assert.NoError(err)
+	assert.Equal([]Sequence{{Name: "invoice_number", Start: 1000, OwnedBy: "number"}}, tables[0].sequences)
+	_, err = Load(strings.NewReader("tables:\n  - name: invoices\n    columns:\n      - name: number\n        datatype: bigint\n    sequences:\n      - name: invoice_number\n        owned_by: num\n"))
+	assert.ErrorContains(err, "line 8")
+}
+
+func TestEnum(t *testing.T) {
+	assert := require.New(t)
+	enum := Enum{Name: "order_status", Values: []string{"draft", "pending", "paid", "shipped"}}
+	assert.NoError(enum.validate())
+	assert.Equal(`CREATE TYPE "public"."order_status" AS ENUM ('draft', 'pending', 'paid', 'shipped')`, enum.createStatement("public"))
+
+	// The missing labels are added in their declared positions
+	statements, err := enum.addValueStatements("public", []string{"pending", "shipped"})
+	assert.NoError(err)
+	assert.Equal([]string{
+		`ALTER TYPE "public"."order_status" ADD VALUE IF NOT EXISTS 'draft' BEFORE 'pending'`,
+		`ALTER TYPE "public"."order_status" ADD VALUE IF NOT EXISTS 'paid' AFTER 'pending'`,
+	}, statements)
+	statements, err = enum.addValueStatements("public", enum.Values)
+	assert.NoError(err)
+	assert.Empty(statements)
+
+	// Removed and reordered labels are refused
+	_, err = enum.addValueStatements("public", []string{"draft", "pending", "cancelled"})
+	var changeErr *EnumChangeError
+	assert.ErrorAs(err, &changeErr)
+	assert.Equal([]string{"cancelled"}, changeErr.Removed)
+	assert.False(changeErr.Reordered)
+	_, err = enum.addValueStatements("public", []string{"paid", "pending"})
+	assert.ErrorAs(err, &changeErr)
+	assert.True(changeErr.Reordered)
+	assert.Empty(changeErr.Removed)
+	// Both are reported when labels are removed and the remaining ones are reordered
+	_, err = enum.addValueStatements("public", []string{"paid", "cancelled", "pending"})
+	assert.ErrorAs(err, &changeErr)
+	assert.Equal([]string{"cancelled"}, changeErr.Removed)
+	assert.True(changeErr.Reordered)
+	assert.ErrorContains(err, "removes the labels cancelled and reorders")
+
+	assert.Error((&Enum{Name: "order_status", Values: []string{"paid", "paid"}}).validate())
+
+	// The table that declares the enum is applied before the tables that use it
+	orders := NewTable(Table{Name: "orders", DefaultSchema: "public"})
+	orders.Append(NewColumn(Column{Name: "status", Datatype: "order_status"}))
+	history := NewTable(Table{Name: "order_history", DefaultSchema: "public"})
+	history.Append(NewColumn(Column{Name: "statuses", Datatype: "public.order_status[]"}))
+	statuses := NewTable(Table{Name: "statuses", DefaultSchema: "public"})
+	statuses.AddEnum(enum)
+	ordered, _ := NewSchema(Schema{Tables: []*Table{orders, history, statuses}}).order()
+	assert.Equal([]*Table{statuses, orders, history}, ordered)
+
+	// Quoted type names are matched exactly, and unquoted ones are folded to lower case
+	tests := []struct {
+		datatype string
+		key      string
+	}{
+		{"order_status", "public.order_status"},
+		{"Order_Status", "public.order_status"},
+		{`"Order_Status"`, "public.Order_Status"},
+		{`"Sales"."Order_Status"[]`, "Sales.Order_Status"},
+		{` sales . order_status [] [] `, "sales.order_status"},
+	}
+	for _, test := range tests {
+		key, ok := enumReference(test.datatype, "public")
+		assert.True(ok, test.datatype)
+		assert.Equal(test.key, key, test.datatype)
+	}
+	mixed := NewTable(Table{Name: "statuses", DefaultSchema: "public"})
+	mixed.AddEnum(Enum{Name: "Order_Status", Values: []string{"draft"}})
+	quoted := NewTable(Table{Name: "orders", DefaultSchema: "public"})
+	quoted.Append(NewColumn(Column{Name: "status", Datatype: `"Order_Status"`}))
+	ordered, _ = NewSchema(Schema{Tables: []*Table{quoted, mixed}}).order()
+	assert.Equal([]*Table{mixed, quoted}, ordered)
+}
+
+func TestNewEnumLabel(t *testing.T) {
+	assert := require.New(t)
+	table, _ := newFakeTable(Table{Name: "orders"}, func(sql string, args []any) ([][]any, error) {
+		if strings.Contains(sql, "t.typtype") {
+			return [][]any{{"e"}}, nil
+		}
+		if strings.Contains(sql, "e.enumlabel") {
+			return [][]any{{"draft"}, {"paid"}}, nil
+		}
+		return nil, nil
+	})
+	table.AddEnum(Enum{Name: "order_status", Values: []string{"draft", "pending", "paid"}})
+	table.Append(NewColumn(Column{Name: "status", Datatype: "order_status"}))
+	table.Append(NewColumn(Column{Name: "note", Datatype: "text"}))
+	plan, err := table.planEnums(context.Background())
+	assert.Nil(err)
+	assert.Len(plan, 1)
+	added := addedLabels(plan)
+	assert.Equal([]addedLabel{{key: "public.order_status", enum: "order_status", label: "pending"}}, added)
+
+	tests := []struct {
+		name      string
+		statement PlannedStatement
+		refused   bool
+	}{
+		{"default of the enum column", PlannedStatement{Table: "orders", Column: "status", Step: StepSetDefault, SQL: `ALTER TABLE "public"."orders" ALTER COLUMN "status" SET DEFAULT 'pending'`}, true},
+		{"backfill of the enum column", PlannedStatement{Table: "orders", Column: "status", Step: StepBackfillDefault, SQL: `UPDATE "public"."orders" SET "status" = 'pending' WHERE "status" IS NULL`}, true},
+		{"existing label", PlannedStatement{Table: "orders", Column: "status", Step: StepSetDefault, SQL: `ALTER TABLE "public"."orders" ALTER COLUMN "status" SET DEFAULT 'draft'`}, false},
+		{"column of another type", PlannedStatement{Table: "orders", Column: "note", Step: StepSetDefault, SQL: `ALTER TABLE "public"."orders" ALTER COLUMN "note" SET DEFAULT 'pending'`}, false},
+		{"constraint", PlannedStatement{Table: "orders", Constraint: "orders_status_check", Step: StepAddConstraint, SQL: `ALTER TABLE "public"."orders" ADD CONSTRAINT "orders_status_check" CHECK (status <> 'pending')`}, true},
+		{"index after commit", PlannedStatement{Table: "orders", Index: "orders_pending", Step: StepCreateIndex, Concurrent: true, SQL: `CREATE INDEX CONCURRENTLY "orders_pending" ON "public"."orders" (id) WHERE status = 'pending'`}, false},
+	}
+	for _, test := range tests {
+		err := table.checkAddedLabels(append(slices.Clone(plan), test.statement), added)
+		if !test.refused {
+			assert.Nil(err, test.name)
+			continue
+		}
+		assert.ErrorIs(err, ErrNewEnumLabel, test.name)
+		var migrationErr *MigrationError
+		assert.ErrorAs(err, &migrationErr, test.name)
+		assert.Equal("order_status", migrationErr.Enum, test.name)
+		assert.Equal(test.statement.Step, migrationErr.Step, test.name)
+	}
+
+	// In a Schema, the labels added by a table applied earlier are checked against the tables applied after it
+	history := NewTable(Table{Name: "order_history", DefaultSchema: "public"})
+	history.Append(NewColumn(Column{Name: "status", Datatype: "public.order_status"}))
+	statement := PlannedStatement{Table: "order_history", Column: "status", Step: StepSetDefault, SQL: `ALTER TABLE "public"."order_history" ALTER COLUMN "status" SET DEFAULT 'pending'`}
+	assert.ErrorIs(history.checkAddedLabels([]PlannedStatement{statement}, added), ErrNewEnumLabel)
+	assert.Nil(history.checkAddedLabels([]PlannedStatement{statement}, nil))
+}
+
+func TestConstraintReferences(t *testing.T) {
+	assert := require.New(t)
+	tests := []struct {
+		value    string
+		expected []string
+	}{
+		{"FOREIGN KEY (client_id) REFERENCES clients (id)", []string{"public.clients"}},
+		{"FOREIGN KEY (client_id) REFERENCES Billing.Clients (id)", []string{"billing.clients"}},
+		{`FOREIGN KEY (client_id) REFERENCES "billing.v2"."Clients" (id)`, []string{"billing.v2.Clients"}},
+		{`FOREIGN KEY (client_id) REFERENCES "say ""hi""" (id)`, []string{`public.say "hi"`}},
+		{"CHECK (amount > 0)", nil},
+	}
+	for _, test := range tests {
+		assert.Equal(test.expected, constraintReferences(test.value, "public"), test.value)
+	}
+	_, ok := parseQualifiedName(`"unterminated`)
+	assert.False(ok)
+}
+
+func TestSchemaPlanLeavesTables(t *testing.T) {
+	assert := require.New(t)
+	// The name is invalid, so planning fails before the database is queried
+	table := NewTable(Table{Name: "", DefaultSchema: "public", Autocommit: true})
+	schema := NewSchema(Schema{Tables: []*Table{table}, DB: &pgxpool.Pool{}})
+	_, err := schema.Plan(context.Background())
+	assert.Error(err)
+	assert.True(table.Autocommit)
+	assert.Nil(table.DB)
+}
+
+func TestPrune(t *testing.T) {
+	assert := require.New(t)
+	existing := [][]any{{"id"}, {"name"}, {"legacy_code"}, {"old_title"}}
+	tests := []struct {
+		mode     string
+		expected []string
+	}{
+		{PruneWarn, nil},
+		{PruneDrop, []string{`ALTER TABLE "public"."items" DROP COLUMN IF EXISTS "legacy_code"`}},
+	}
+	for _, test := range tests {
+		table, _ := newFakeTable(Table{Name: "items", PruneMode: test.mode}, func(sql string, args []any) ([][]any, error) {
+			if strings.Contains(sql, "ORDER BY ordinal_position") {
+				return existing, nil
+			}
+			return nil, nil
+		})
+		table.Append(NewColumn(Column{Name: "id", Datatype: "bigserial"}))
+		table.Append(NewColumn(Column{Name: "name", Datatype: "text"}))
+		// The previous names of a column are not pruned, since they are renamed
+		table.Append(NewColumn(Column{Name: "title", Datatype: "text", RenamedFrom: []string{"old_title"}}))
+		undeclared, err := table.UndeclaredColumns(context.Background())
+		assert.NoError(err)
+		assert.Equal([]string{"legacy_code"}, undeclared)
+		plan, err := table.planPrune(context.Background())
+		assert.NoError(err)
+		var statements []string
+		for _, p := range plan {
+			assert.Equal(StepDropColumn, p.Step)
+			statements = append(statements, p.SQL)
+		}
+		assert.Equal(test.expected, statements, test.mode)
+	}
+}
+
+func TestDropColumn(t *testing.T) {
+	assert := require.New(t)
+	tests := []struct {
+		existing []string
+		expected []string
+	}{
+		{[]string{"legacy_code"}, []string{`ALTER TABLE "public"."items" DROP COLUMN IF EXISTS "legacy_code"`}},
+		{nil, nil},
+	}
+	for _, test := range tests {
+		table, _ := newFakeTable(Table{Name: "items"}, columnsAnswer(test.existing...))
+		plan, err := table.planColumn(context.Background(), NewColumn(Column{Name: "legacy_code", Datatype: "text", Action: ActionDrop}))
+		assert.NoError(err)
+		var statements []string
+		for _, p := range plan {
+			statements = append(statements, p.SQL)
+		}
+		assert.Equal(test.expected, statements)
+	}
+}
+
+func TestRenameColumn(t *testing.T) {
+	assert := require.New(t)
+	col := NewColumn(Column{Name: "title", Datatype: "text", RenamedFrom: []string{"heading", "old_title"}})
+	rename := `ALTER TABLE "public"."items" RENAME COLUMN "old_title" TO "title"`
+	index := `ALTER INDEX IF EXISTS "public"."items_old_title_index" RENAME TO "items_title_index"`
+	unique := `ALTER TABLE "public"."items" RENAME CONSTRAINT "items_old_title_unique" TO "items_title_unique"`
+	primary := `ALTER TABLE "public"."items" RENAME CONSTRAINT "items_old_title" TO "items_title"`
+	foreignKey := `ALTER TABLE "public"."items" RENAME CONSTRAINT "items_old_title_fkey" TO "items_title_fkey"`
+	tests := []struct {
+		constraints []string
+		expected    []string
+	}{
+		{nil, []string{rename, index}},
+		{[]string{"items_old_title_unique"}, []string{rename, index, unique}},
+		{[]string{"items_old_title_unique", "items_old_title"}, []string{rename, index, unique, primary}},
+		{[]string{"items_old_title_fkey"}, []string{rename, index, foreignKey}},
+	}
+	for _, test := range tests {
+		columns := columnsAnswer("old_title")
+		table, _ := newFakeTable(Table{Name: "items"}, func(sql string, args []any) ([][]any, error) {
+			if strings.Contains(sql, "con.conname = $3") {
+				return [][]any{{slices.Contains(test.constraints, args[2].(string))}}, nil
+			}
+			return columns(sql, args)
+		})
+		plan, from, err := table.planRename(context.Background(), col)
+		assert.NoError(err)
+		assert.Equal("old_title", from)
+		var statements []string
+		for _, p := range plan {
+			assert.Equal(StepRenameColumn, p.Step)
+			statements = append(statements, p.SQL)
+		}
+		assert.Equal(test.expected, statements, test.constraints)
+	}
+
+	// Nothing is renamed when none of the previous names exist
+	table, _ := newFakeTable(Table{Name: "items"}, columnsAnswer())
+	plan, from, err := table.planRename(context.Background(), col)
+	assert.NoError(err)
+	assert.Empty(from)
+	assert.Empty(plan)
+}
+
+func TestRenameForeignKey(t *testing.T) {
+	assert := require.New(t)
+	col := NewColumn(Column{Name: "title", Datatype: "text", RenamedFrom: []string{"old_title"}, References: &ForeignKey{Table: "titles", Column: "id"}})
+	var looked []string
+	table, _ := newFakeTable(Table{Name: "items"}, func(sql string, args []any) ([][]any, error) {
+		if strings.Contains(sql, "con.contype = 'f'") {
+			looked = append(looked, args[2].(string))
+			if args[2] == "items_old_title_fkey" {
+				return [][]any{{"public", "titles", "id", "a", "a", false, false}}, nil
+			}
+			return [][]any{}, nil
+		}
+		return columnsAnswer("old_title")(sql, args)
+	})
+	// The foreign key is renamed along with the column, so the unchanged one under the previous name is kept
+	plan, err := table.planForeignKey(context.Background(), col)
+	assert.NoError(err)
+	assert.Empty(plan)
+	assert.Equal([]string{"items_old_title_fkey"}, looked)
+}
+
+func TestRemovedFlagSteps(t *testing.T) {
+	assert := require.New(t)
+	tests := []struct {
+		name        string
+		col         Column
+		state       columnState
+		constraints []string
+		expected    []int
+	}{
+		{"nothing removed", Column{Name: "email", Datatype: "text", DefaultExists: true, DefaultValue: "''", IsNotNull: true}, columnState{notNull: true, defaultValue: "''::text"}, nil, nil},
+		{"default", Column{Name: "email", Datatype: "text"}, columnState{defaultValue: "''::text"}, nil, []int{StepDropDefault}},
+		{"not null", Column{Name: "email", Datatype: "text"}, columnState{notNull: true}, nil, []int{StepDropNotNull}},
+		{"unique", Column{Name: "email", Datatype: "text"}, columnState{}, []string{"users_email_unique"}, []int{StepDropUnique}},
+		// Defaults and NOT NULL that PostgreSQL manages for serial, identity and generated columns are left alone
+		{"serial", Column{Name: "id", Datatype: "bigint"}, columnState{notNull: true, defaultValue: "nextval('users_id_seq'::regclass)"}, nil, nil},
+		{"identity", Column{Name: "id", Datatype: "bigint"}, columnState{notNull: true, identity: "a"}, nil, nil},
+		{"generated", Column{Name: "total", Datatype: "bigint"}, columnState{defaultValue: "(price * quantity)", generated: "s"}, nil, nil},
+		// A member of the primary key keeps NOT NULL, unless its own primary key is dropped along with it
+		{"primary key member", Column{Name: "tenant_id", Datatype: "bigint"}, columnState{notNull: true, inPrimaryKey: true}, nil, nil},
+		{"primary key dropped", Column{Name: "email", Datatype: "text"}, columnState{notNull: true, inPrimaryKey: true}, []string{"users_email"}, []int{StepDropPrimaryKey, StepDropNotNull}},
+		{"still primary", Column{Name: "email", Datatype: "text", IsPrimary: true}, columnState{notNull: true, inPrimaryKey: true}, []string{"users_email"}, nil},
+	}
+	for _, test := range tests {
+		table, _ := newFakeTable(Table{Name: "users"}, func(sql string, args []any) ([][]any, error) {
+			if strings.Contains(sql, "con.conname = $3") {
+				return [][]any{{slices.Contains(test.constraints, args[2].(string))}}, nil
+			}
+			return nil, nil
+		})
+		steps, err := table.removedFlagSteps(context.Background(), test.col, test.state)
+		assert.NoError(err, test.name)
+		assert.Equal(test.expected, steps, test.name)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	assert := require.New(t)
+	build := func() *Table {
+		table := NewTable(Table{Name: "items", DefaultSchema: "public", AppVersion: "1.2.0"})
+		table.Append(NewColumn(Column{Name: "id", Datatype: "bigserial", IsPrimary: true}))
+		table.Append(NewColumn(Column{Name: "name", Datatype: "text", IsNotNull: true}))
+		table.AddConstraint(Constraint{Name: "items_name_check", Value: "CHECK (name <> '')"})
+		return table
+	}
+	table := build()
+	hash := table.definitionHash()
+	assert.Len(hash, 64)
+
+	// The hash only depends on the declaration
+	other := build()
+	other.AppVersion = "2.0.0"
+	other.Autocommit = true
+	other.RecordHistory = true
+	assert.Equal(hash, other.definitionHash())
+	changes := map[string]func(*Table){
+		"column":     func(t *Table) { t.Columns[1].IsNotNull = false },
+		"order":      func(t *Table) { t.Columns[0], t.Columns[1] = t.Columns[1], t.Columns[0] },
+		"constraint": func(t *Table) { t.constraints[0].Value = "CHECK (name <> 'x')" },
+		"index":      func(t *Table) { t.AddIndex(Index{Name: "items_name", Columns: []IndexColumn{{Name: "name"}}}) },
+		"comment":    func(t *Table) { t.Comment = "Items on sale" },
+	}
+	for name, change := range changes {
+		changed := build()
+		change(changed)
+		assert.NotEqual(hash, changed.definitionHash(), name)
+	}
+
+	tx := &fakeTx{}
+	statement := PlannedStatement{Table: "items", Column: "name", Step: StepNotNull, SQL: `ALTER TABLE "public"."items" ALTER COLUMN "name" SET NOT NULL`}
+	assert.NoError(table.recordHistory(context.Background(), tx, statement, 1500*time.Microsecond, hash))
+	assert.Len(tx.executed, 1)
+	assert.Contains(tx.executed[0], `INSERT INTO "public"."schemamagic_history"`)
+	assert.Equal([]any{"items", "name", "", StepNotNull, statement.SQL, int64(1500), "1.2.0", hash}, tx.args[0])
+}
+
+func TestLock(t *testing.T) {
+	assert := require.New(t)
+	assert.Equal(lockKey("shop", "public"), lockKey("shop", "public"))
+	assert.NotEqual(lockKey("shop", "public"), lockKey("shop", "billing"))
+
+	// The lock is retried until the instance holding it is done
+	attempts := 0
+	tx := &fakeTx{query: func(sql string, args []any) ([][]any, error) {
+		if strings.Contains(sql, "pg_try_advisory_xact_lock") {
+			attempts++
+			assert.Equal(lockKey("shop", "public"), args[0])
+			return [][]any{{attempts == 3}}, nil
+		}
+		return nil, nil
+	}}
+	assert.NoError(acquireLock(context.Background(), tx, "shop", "public", 0))
+	assert.Equal(3, attempts)
+
+	held := &fakeTx{query: func(sql string, args []any) ([][]any, error) {
+		return [][]any{{false}}, nil
+	}}
+	assert.ErrorIs(acquireLock(context.Background(), held, "shop", "public", 150*time.Millisecond), ErrLockTimeout)
+}
+
+func TestPlanChanges(t *testing.T) {
+	assert := require.New(t)
+	schema := PlannedStatement{Table: "items", Step: StepCreateSchema, SQL: `CREATE SCHEMA IF NOT EXISTS "public"`}
+	tests := []struct {
+		plan     []PlannedStatement
+		expected bool
+	}{
+		{nil, false},
+		{[]PlannedStatement{schema}, false},
+		{[]PlannedStatement{schema, {Table: "items", Step: StepCreateTable, SQL: `CREATE TABLE "public"."items"()`}}, true},
+		{[]PlannedStatement{schema, {Table: "items", Index: "items_name", Step: StepCreateIndex, SQL: `CREATE INDEX "items_name" ON "public"."items" ("name")`}}, true},
+	}
+	for _, test := range tests {
+		assert.Equal(test.expected, planChanges(test.plan))
+	}
+}
+
+func TestSkipMigratedTable(t *testing.T) {
+	assert := require.New(t)
+	// Once the lock is acquired, the table is planned against the DB: when another instance has already migrated it, there's nothing to execute (or record), while drift is still corrected
+	tests := []struct {
+		description string
+		expected    []string
+	}{
+		{"Items on sale", nil},
+		{"Changed by hand", []string{`CREATE SCHEMA IF NOT EXISTS "public"`, `COMMENT ON TABLE "public"."items" IS 'Items on sale'`}},
+	}
+	for _, test := range tests {
+		table, tx := newFakeTable(Table{Name: "items", Lock: true, Comment: "Items on sale"}, func(sql string, args []any) ([][]any, error) {
+			switch {
+			case strings.Contains(sql, "pg_try_advisory_xact_lock"), strings.Contains(sql, "c.relkind = 'r'"):
+				return [][]any{{true}}, nil
+			case strings.Contains(sql, "pg_catalog.pg_index"):
+				return [][]any{}, nil
+			case strings.Contains(sql, "obj_description"):
+				return [][]any{{test.description}}, nil
+			}
+			return nil, nil
+		})
+		assert.NoError(table.apply(context.Background()))
+		assert.Equal(test.expected, tx.executed, test.description)
+	}
+}
+
+func TestSkipUnchangedConstraint(t *testing.T) {
+	assert := require.New(t)
+	// A CHECK constraint that is unchanged (as printed by pg_get_constraintdef) leaves nothing to execute under the lock, for the table as well as for the schema
+	for _, defined := range []string{`CHECK ((name <> ''::text))`, `CHECK ((name <> 'x'::text))`} {
+		table, tx := newFakeTable(Table{Name: "items", Lock: true}, func(sql string, args []any) ([][]any, error) {
+			switch {
+			case strings.Contains(sql, "pg_try_advisory_xact_lock"), strings.Contains(sql, "c.relkind = 'r'"):
+				return [][]any{{true}}, nil
+			case strings.Contains(sql, "pg_get_constraintdef"):
+				return [][]any{{defined}}, nil
+			case strings.Contains(sql, "pg_catalog.pg_index"):
+				return [][]any{}, nil
+			}
+			return nil, nil
+		})
+		table.AddConstraint(Constraint{Name: "items_name_check", Value: "CHECK (name <> '')"})
+		assert.NoError(table.apply(context.Background()))
+		schema := NewSchema(Schema{Tx: tx, Lock: true, Tables: []*Table{table}})
+		assert.NoError(schema.apply(context.Background()))
+		if strings.Contains(defined, "'x'") {
+			assert.Len(tx.executed, 6, defined)
+			assert.Contains(tx.executed[1], `DROP CONSTRAINT IF EXISTS "items_name_check"`)
+			continue
+		}
+		assert.Empty(tx.executed, defined)
+	}
+}
+
+func TestStructTagValues(t *testing.T) {
+	assert := require.New(t)
+	type counter struct {
+		Hits      uint64 `schemamagic:"notnull"`
+		Visits    uint
+		Small     uint8
+		Separator string `schemamagic:"default:'a;b';notnull;comment:'Joined by ; and '' quotes'"`
+		Reserved  string `schemamagic:"default:\"Quoted;Column\""`
+	}
+	table, err := NewTableFromStruct(Table{Name: "counters", DefaultSchema: "public"}, counter{})
+	assert.NoError(err)
+	assert.Equal(NewColumn(Column{Name: "hits", Datatype: "numeric(20)", IsNotNull: true}), table.Columns[0])
+	assert.Equal("numeric(20)", table.Columns[1].Datatype)
+	assert.Equal("smallint", table.Columns[2].Datatype)
+	assert.Equal(NewColumn(Column{Name: "separator", Datatype: "text", DefaultExists: true, DefaultValue: "'a;b'", IsNotNull: true, Comment: "Joined by ; and ' quotes"}), table.Columns[3])
+	assert.Equal(`"Quoted;Column"`, table.Columns[4].DefaultValue)
+
+	assert.Equal([]string{"default:'it''s;here'", "notnull"}, splitTagOptions("default:'it''s;here';notnull"))
+}
+
+// cents is a struct that is stored through its driver.Valuer, as the types of pgtype are
+type cents struct{ amount int64 }
+
+func (c cents) Value() (driver.Value, error) { return c.amount, nil }
+
+// code is a struct that is read through its sql.Scanner
+type code struct{ value string }
+
+func (c *code) Scan(src any) error { return nil }
+
+func TestStructTagNullTypes(t *testing.T) {
+	assert := require.New(t)
+	tests := []struct {
+		value    any
+		datatype string
+	}{
+		{sql.NullString{}, "text"},
+		{sql.NullInt64{}, "bigint"},
+		{sql.NullInt32{}, "integer"},
+		{sql.NullInt16{}, "smallint"},
+		{sql.NullFloat64{}, "double precision"},
+		{sql.NullBool{}, "boolean"},
+		{sql.NullTime{}, "timestamp with time zone"},
+		{&sql.NullString{}, "text"},
+		{sql.Null[int32]{}, "integer"},
+		{sql.Null[time.Time]{}, "timestamp with time zone"},
+		{[]sql.NullString{}, "text[]"},
+		{struct{ Name string }{}, "jsonb"},
+	}
+	for _, test := range tests {
+		datatype, err := postgresDatatype(reflect.TypeOf(test.value))
+		assert.NoError(err, "%T", test.value)
+		assert.Equal(test.datatype, datatype, "%T", test.value)
+	}
+
+	// Other structs that are stored through their driver methods need the datatype option
+	for _, value := range []any{cents{}, code{}} {
+		_, err := postgresDatatype(reflect.TypeOf(value))
+		assert.ErrorContains(err, "set it with the datatype option", "%T", value)
+	}
+	type payment struct {
+		Amount cents `schemamagic:"datatype:bigint"`
+		Code   code
+	}
+	_, err := NewTableFromStruct(Table{Name: "payments", DefaultSchema: "public"}, payment{})
+	assert.ErrorContains(err, "code")
+	type tagged struct {
+		Amount cents `schemamagic:"datatype:bigint"`
+	}
+	table, err := NewTableFromStruct(Table{Name: "payments", DefaultSchema: "public"}, tagged{})
+	assert.NoError(err)
+	assert.Equal("bigint", table.Columns[0].Datatype)
+}
+
+func TestDerivedIdentifiers(t *testing.T) {
+	assert := require.New(t)
+	// "invoice_line_items_" + 40 bytes of column is 59 bytes, which fits, but the names derived from it don't
+	column := strings.Repeat("c", 40)
+	tests := []struct {
+		col      Column
+		expected string
+	}{
+		{Column{Name: column, Datatype: "text"}, ""},
+		{Column{Name: column, Datatype: "text", IsUnique: true}, "unique constraint name"},
+		{Column{Name: column, Datatype: "text", IndexRequired: true}, "index name"},
+		{Column{Name: column, Datatype: "bigint", References: &ForeignKey{Table: "invoices", Column: "id"}}, "foreign key name"},
+		{Column{Name: column, Datatype: "text", IsNotNull: true, SafeNotNull: true}, "not null check name"},
+		{Column{Name: column, Datatype: "text", IsUnique: true, Action: ActionDrop}, ""},
+	}
+	for _, test := range tests {
+		table := NewTable(Table{Name: "invoice_line_items", DefaultSchema: "public"})
+		table.Append(NewColumn(test.col))
+		err := table.validate()
+		if test.expected == "" {
+			assert.NoError(err)
+			continue
+		}
+		assert.ErrorContains(err, test.expected)
+	}
+	// The primary key is named <table>_<column>, which is 64 bytes long here
+	table := NewTable(Table{Name: "invoice_line_items", DefaultSchema: "public"})
+	table.Append(NewColumn(Column{Name: strings.Repeat("c", 45), Datatype: "bigint", IsPrimary: true}))
+	assert.ErrorContains(table.validate(), "primary key name")
+}
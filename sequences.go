@@ -0,0 +1,276 @@
+package schemamagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	pgx "github.com/jackc/pgx/v5"
+)
+
+// sequenceBacked returns if the values of the column are generated by a sequence, which is the case for serial and identity columns
+func (c *Column) sequenceBacked() bool {
+	return strings.Contains(c.Datatype, "serial") || c.Identity != ""
+}
+
+// hasSequenceOptions returns if any of the options of the sequence of the column are declared
+func (c *Column) hasSequenceOptions() bool {
+	return c.SequenceMin != 0 || c.SequenceMax != 0 || c.SequenceCache != 0 || c.SequenceCycle
+}
+
+// validateSequence checks that the sequence options of the column can be applied
+func (c *Column) validateSequence() error {
+	if (c.hasSequenceOptions() || c.SequenceRestartIfLower) && !c.sequenceBacked() {
+		return errors.New("sequence options need a serial datatype or an identity")
+	}
+	if c.SequenceMin != 0 && c.SequenceMax != 0 && c.SequenceMin > c.SequenceMax {
+		return fmt.Errorf("sequence_min %d is greater than sequence_max %d", c.SequenceMin, c.SequenceMax)
+	}
+	if c.SequenceCache < 0 {
+		return fmt.Errorf("invalid sequence_cache %d", c.SequenceCache)
+	}
+	if c.SequenceRestartIfLower && c.SequenceRestart == 0 {
+		return errors.New("sequence_restart_if_lower needs a sequence_restart")
+	}
+	return nil
+}
+
+// serialSequence returns the expression that resolves the sequence owned by the column when the statement is executed. pg_get_serial_sequence returns the schema qualified (and quoted) name of the sequence, which can differ from <table>_<column>_seq
+func serialSequence(tableName string, schema string, columnName string) string {
+	return fmt.Sprintf("pg_get_serial_sequence(%s, %s)", quoteLiteral(qualifiedName(schema, tableName)), quoteLiteral(columnName))
+}
+
+// sequenceRestart returns the statement that restarts the sequence of the column with SequenceRestart. With SequenceRestartIfLower, the sequence is only moved forward, when the next value it would hand out is lower than SequenceRestart
+func (c *Column) sequenceRestart(tableName string, schema string) string {
+	sequence := serialSequence(tableName, schema, c.Name)
+	statement := fmt.Sprintf("SELECT setval(%s, %d, false)", sequence, c.SequenceRestart)
+	if c.SequenceRestartIfLower {
+		// pg_sequence_last_value is NULL until the sequence has been used, in which case the next value is the start of the sequence
+		statement = fmt.Sprintf("%s WHERE (SELECT coalesce(pg_sequence_last_value(s.seqrelid) + s.seqincrement, s.seqstart) FROM pg_catalog.pg_sequence s WHERE s.seqrelid = %s::regclass) < %d", statement, sequence, c.SequenceRestart)
+	}
+	return statement
+}
+
+// sequenceOptions returns the options of ALTER SEQUENCE that set the declared minimum, maximum, cache and cycle of the sequence
+func (c *Column) sequenceOptions() string {
+	var options []string
+	if c.SequenceMin != 0 {
+		options = append(options, fmt.Sprintf("MINVALUE %d", c.SequenceMin))
+	}
+	if c.SequenceMax != 0 {
+		options = append(options, fmt.Sprintf("MAXVALUE %d", c.SequenceMax))
+	}
+	if c.SequenceCache != 0 {
+		options = append(options, fmt.Sprintf("CACHE %d", c.SequenceCache))
+	}
+	if c.SequenceCycle {
+		options = append(options, "CYCLE")
+	} else {
+		options = append(options, "NO CYCLE")
+	}
+	return strings.Join(options, " ")
+}
+
+// planSequenceOptions compares the options of the sequence owned by the column (from pg_sequence) with the declaration, and returns the statement that alters the ones that differ.
+// When the sequence doesn't exist yet (the column is added, or converted into an identity, by the same plan), its name is resolved when the statement is executed, so the statement is a DO block
+func (t *Table) planSequenceOptions(ctx context.Context, col Column, existingName string, columnPresence bool) ([]PlannedStatement, error) {
+	if !col.sequenceBacked() || !col.hasSequenceOptions() {
+		return nil, nil
+	}
+	statement := func(sql string) []PlannedStatement {
+		return []PlannedStatement{{Table: t.Name, Column: col.Name, Step: StepSequenceOptions, SQL: sql}}
+	}
+	deferred := fmt.Sprintf("DO $schemamagic$\nBEGIN\n\tEXECUTE format('ALTER SEQUENCE %%s %s', %s);\nEND\n$schemamagic$", col.sequenceOptions(), serialSequence(t.Name, t.DefaultSchema, col.Name))
+	if !columnPresence {
+		return statement(deferred), nil
+	}
+	var name string
+	var min, max, cache int64
+	var cycle bool
+	query := "SELECT pg_get_serial_sequence($1, $2), s.seqmin, s.seqmax, s.seqcache, s.seqcycle FROM pg_catalog.pg_sequence s WHERE s.seqrelid = pg_get_serial_sequence($1, $2)::regclass"
+	err := t.Tx.QueryRow(ctx, query, qualifiedName(t.DefaultSchema, t.Name), existingName).Scan(&name, &min, &max, &cache, &cycle)
+	if errors.Is(err, pgx.ErrNoRows) {
+		log.Debugln("Column --> ", col.Name, " doesn't own a sequence yet")
+		return statement(deferred), nil
+	}
+	if err != nil {
+		log.Warningln("While querying for the sequence of column --> ", col.Name, " in table --> ", t.Name, " error is --> ", err)
+		return nil, &MigrationError{Table: t.Name, Column: col.Name, SQL: query, Err: err}
+	}
+	if (col.SequenceMin == 0 || col.SequenceMin == min) && (col.SequenceMax == 0 || col.SequenceMax == max) && (col.SequenceCache == 0 || col.SequenceCache == cache) && col.SequenceCycle == cycle {
+		return nil, nil
+	}
+	log.Debugln("Options of sequence --> ", name, " of column --> ", col.Name, " have changed")
+	return statement(fmt.Sprintf("ALTER SEQUENCE %s %s", name, col.sequenceOptions())), nil
+}
+
+// Sequence is a sequence that isn't owned by a serial or identity column, such as one that numbers invoices through a default of nextval('invoice_number'). It is added through Table.AddSequence, created if it doesn't exist, and altered when its options change.
+// Options that are 0 are left to PostgreSQL when the sequence is created, and left unchanged when it exists
+type Sequence struct {
+	Name      string `yaml:"name"`                // Name of the sequence
+	Schema    string `yaml:"schema,omitempty"`    // Schema of the sequence. Defaults to the DefaultSchema of the table
+	Start     int64  `yaml:"start,omitempty"`     // Value that the sequence starts with. Changing it doesn't change the current value of the sequence
+	Increment int64  `yaml:"increment,omitempty"` // Value that the sequence is incremented by
+	Min       int64  `yaml:"min,omitempty"`       // Minimum value of the sequence
+	Max       int64  `yaml:"max,omitempty"`       // Maximum value of the sequence
+	Cache     int64  `yaml:"cache,omitempty"`     // Number of values that are preallocated by each session
+	Cycle     bool   `yaml:"cycle,omitempty"`     // Denotes if the sequence wraps around once it reaches its maximum (or minimum) value
+	OwnedBy   string `yaml:"owned_by,omitempty"`  // Column of the table that owns the sequence, so that the sequence is dropped along with it. Empty leaves the owner unchanged
+}
+
+// existingSequence is a sequence as read from pg_sequence
+type existingSequence struct {
+	start, increment, min, max, cache int64
+	cycle                             bool
+}
+
+// AddSequence accepts a sequence and appends it to the list of sequences that need to be created along with the table
+func (t *Table) AddSequence(sequence Sequence) {
+	t.sequences = append(t.sequences, sequence)
+}
+
+// schema returns the schema of the sequence, which defaults to the schema of the table
+func (s *Sequence) schema(defaultSchema string) string {
+	if s.Schema == "" {
+		return defaultSchema
+	}
+	return s.Schema
+}
+
+// validate checks that the sequence can be created with the declared options
+func (s *Sequence) validate() error {
+	if err := validateIdentifier("sequence", s.Name); err != nil {
+		return err
+	}
+	if s.Schema != "" {
+		if err := validateIdentifier("sequence schema", s.Schema); err != nil {
+			return err
+		}
+	}
+	if s.Min != 0 && s.Max != 0 && s.Min > s.Max {
+		return fmt.Errorf("sequence %s has a min %d greater than its max %d", s.Name, s.Min, s.Max)
+	}
+	if s.Cache < 0 {
+		return fmt.Errorf("sequence %s has an invalid cache %d", s.Name, s.Cache)
+	}
+	if s.OwnedBy != "" {
+		if err := validateIdentifier("owning column", s.OwnedBy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// options returns the options of CREATE SEQUENCE or ALTER SEQUENCE that set the declared values. When existing is not nil, only the options that differ from it are returned
+func (s *Sequence) options(existing *existingSequence) []string {
+	var options []string
+	if s.Increment != 0 && (existing == nil || existing.increment != s.Increment) {
+		options = append(options, fmt.Sprintf("INCREMENT BY %d", s.Increment))
+	}
+	if s.Min != 0 && (existing == nil || existing.min != s.Min) {
+		options = append(options, fmt.Sprintf("MINVALUE %d", s.Min))
+	}
+	if s.Max != 0 && (existing == nil || existing.max != s.Max) {
+		options = append(options, fmt.Sprintf("MAXVALUE %d", s.Max))
+	}
+	if s.Start != 0 && (existing == nil || existing.start != s.Start) {
+		options = append(options, fmt.Sprintf("START WITH %d", s.Start))
+	}
+	if s.Cache != 0 && (existing == nil || existing.cache != s.Cache) {
+		options = append(options, fmt.Sprintf("CACHE %d", s.Cache))
+	}
+	if existing != nil && existing.cycle != s.Cycle {
+		if s.Cycle {
+			options = append(options, "CYCLE")
+		} else {
+			options = append(options, "NO CYCLE")
+		}
+	} else if existing == nil && s.Cycle {
+		options = append(options, "CYCLE")
+	}
+	return options
+}
+
+// fetchSequence reads the options of the sequence from pg_sequence. nil is returned if the sequence doesn't exist
+func (t *Table) fetchSequence(ctx context.Context, schema string, name string) (*existingSequence, error) {
+	var existing existingSequence
+	query := `
+		SELECT s.seqstart, s.seqincrement, s.seqmin, s.seqmax, s.seqcache, s.seqcycle
+			FROM pg_catalog.pg_sequence s
+			JOIN pg_catalog.pg_class c ON c.oid = s.seqrelid
+			JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+			WHERE n.nspname = $1 AND c.relname = $2
+	`
+	err := t.Tx.QueryRow(ctx, query, schema, name).Scan(&existing.start, &existing.increment, &existing.min, &existing.max, &existing.cache, &existing.cycle)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		log.Warningln("While querying for sequence --> ", name, " error is --> ", err)
+		return nil, &MigrationError{Table: t.Name, SQL: query, Err: err}
+	}
+	return &existing, nil
+}
+
+// planSequences returns the statements that create the sequences declared with AddSequence, or alter the options that have changed. They are planned before the columns, whose defaults can call nextval on them
+func (t *Table) planSequences(ctx context.Context) ([]PlannedStatement, error) {
+	var plan []PlannedStatement
+	for _, sequence := range t.sequences {
+		schema := sequence.schema(t.DefaultSchema)
+		name := qualifiedName(schema, sequence.Name)
+		existing, err := t.fetchSequence(ctx, schema, sequence.Name)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			log.Debugln("Sequence --> ", name, " does not exist")
+			if schema != t.DefaultSchema {
+				plan = append(plan, PlannedStatement{Table: t.Name, Step: StepCreateSchema, SQL: fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", quoteIdentifier(schema))})
+			}
+			statement := strings.Join(append([]string{"CREATE SEQUENCE IF NOT EXISTS " + name}, sequence.options(nil)...), " ")
+			plan = append(plan, PlannedStatement{Table: t.Name, Step: StepCreateSequence, SQL: statement})
+			continue
+		}
+		options := sequence.options(existing)
+		if len(options) == 0 {
+			continue
+		}
+		log.Debugln("Options of sequence --> ", name, " have changed")
+		statement := strings.Join(append([]string{"ALTER SEQUENCE " + name}, options...), " ")
+		plan = append(plan, PlannedStatement{Table: t.Name, Step: StepAlterSequence, SQL: statement})
+	}
+	return plan, nil
+}
+
+// planSequenceOwners returns the statements that make the declared columns own their sequences. They are planned once the columns exist, and only for the sequences whose owner (from pg_depend) differs
+func (t *Table) planSequenceOwners(ctx context.Context) ([]PlannedStatement, error) {
+	var plan []PlannedStatement
+	table := qualifiedName(t.DefaultSchema, t.Name)
+	for _, sequence := range t.sequences {
+		if sequence.OwnedBy == "" {
+			continue
+		}
+		name := qualifiedName(sequence.schema(t.DefaultSchema), sequence.Name)
+		var owned bool
+		query := `
+			SELECT EXISTS (
+				SELECT 1 FROM pg_catalog.pg_depend d
+					JOIN pg_catalog.pg_attribute a ON a.attrelid = d.refobjid AND a.attnum = d.refobjsubid
+					WHERE d.classid = 'pg_catalog.pg_class'::regclass AND d.objid = to_regclass($1)
+					AND d.refclassid = 'pg_catalog.pg_class'::regclass AND d.refobjid = to_regclass($2)
+					AND d.deptype = 'a' AND a.attname = $3
+			)
+		`
+		if err := t.Tx.QueryRow(ctx, query, name, table, sequence.OwnedBy).Scan(&owned); err != nil {
+			log.Warningln("While querying for the owner of sequence --> ", name, " error is --> ", err)
+			return nil, &MigrationError{Table: t.Name, SQL: query, Err: err}
+		}
+		if owned {
+			continue
+		}
+		statement := fmt.Sprintf("ALTER SEQUENCE %s OWNED BY %s.%s", name, table, quoteIdentifier(sequence.OwnedBy))
+		plan = append(plan, PlannedStatement{Table: t.Name, Column: sequence.OwnedBy, Step: StepSequenceOwner, SQL: statement})
+	}
+	return plan, nil
+}
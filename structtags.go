@@ -0,0 +1,283 @@
+package schemamagic
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// TagName is the struct tag read by NewTableFromStruct
+const TagName = "schemamagic"
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	bytesType      = reflect.TypeOf([]byte{})
+	valuerType     = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+	scannerType    = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+	// nullTypes maps the nullable wrappers of database/sql to the datatype of the value they wrap
+	nullTypes = map[reflect.Type]string{
+		reflect.TypeOf(sql.NullString{}):  "text",
+		reflect.TypeOf(sql.NullInt64{}):   "bigint",
+		reflect.TypeOf(sql.NullInt32{}):   "integer",
+		reflect.TypeOf(sql.NullInt16{}):   "smallint",
+		reflect.TypeOf(sql.NullByte{}):    "smallint",
+		reflect.TypeOf(sql.NullFloat64{}): "double precision",
+		reflect.TypeOf(sql.NullBool{}):    "boolean",
+		reflect.TypeOf(sql.NullTime{}):    "timestamp with time zone",
+	}
+)
+
+// NewTableFromStruct creates a table (with the Name, DefaultSchema, Database, Tx, etc. of t) whose columns are built from the exported fields of the model, which is a struct value or a pointer to one.
+// Each field is configured through the schemamagic struct tag, as semicolon separated options: `schemamagic:"name:id;datatype:bigserial;primary"`. The options are
+//
+//	name:<name>               name of the column (defaults to the name in the json tag, or to the field name in snake_case)
+//	datatype:<datatype>       datatype of the column (defaults to the datatype mapped from the Go type)
+//	pseudo_datatype:<name>    sets PseudoDatatype
+//	default:<expression>      sets DefaultExists and DefaultValue
+//	unique, primary, notnull  set IsUnique, IsPrimary and IsNotNull
+//	index, index_type:<type>  set IndexRequired and IndexType
+//	index_concurrently        sets IndexRequired and IndexConcurrently
+//	identity:<kind>           sets Identity (ALWAYS or BY DEFAULT)
+//	sequence_restart:<n>      sets SequenceRestart
+//	comment:<text>            sets Comment. Write it as a single quoted literal ('...') if it contains a semicolon
+//
+// Semicolons inside single quoted literals (such as default:'a;b') and double quoted identifiers don't separate options.
+// Fields tagged with "-" are skipped, and embedded structs are flattened
+func NewTableFromStruct(t Table, model interface{}) (*Table, error) {
+	value := reflect.ValueOf(model)
+	if value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("schemamagic: %T is not a struct", model)
+	}
+	columns, err := structColumns(value.Type())
+	if err != nil {
+		return nil, err
+	}
+	table := NewTable(t)
+	for _, col := range columns {
+		table.Append(col)
+	}
+	return table, nil
+}
+
+// structColumns returns the columns for the fields of the struct type
+func structColumns(structType reflect.Type) ([]Column, error) {
+	var columns []Column
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		tag := field.Tag.Get(TagName)
+		if tag == "-" || field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && tag == "" && fieldType.Kind() == reflect.Struct && fieldType != timeType {
+			embedded, err := structColumns(fieldType)
+			if err != nil {
+				return nil, err
+			}
+			columns = append(columns, embedded...)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		col, err := fieldColumn(field, tag)
+		if err != nil {
+			return nil, fmt.Errorf("schemamagic: field %s.%s: %w", structType.Name(), field.Name, err)
+		}
+		columns = append(columns, NewColumn(col))
+	}
+	return columns, nil
+}
+
+// fieldColumn parses the tag of the field into a column
+func fieldColumn(field reflect.StructField, tag string) (Column, error) {
+	var col Column
+	for _, option := range splitTagOptions(tag) {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(option, ":")
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "name":
+			col.Name = value
+		case "datatype":
+			col.Datatype = value
+		case "pseudo_datatype":
+			col.PseudoDatatype = value
+		case "default":
+			col.DefaultExists = true
+			col.DefaultValue = value
+		case "unique":
+			col.IsUnique = true
+		case "primary":
+			col.IsPrimary = true
+		case "notnull":
+			col.IsNotNull = true
+		case "index":
+			col.IndexRequired = true
+		case "index_type":
+			col.IndexRequired = true
+			col.IndexType = value
+		case "index_concurrently":
+			col.IndexRequired = true
+			col.IndexConcurrently = true
+		case "identity":
+			col.Identity = value
+		case "sequence_restart":
+			restart, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return col, fmt.Errorf("invalid sequence_restart %q", value)
+			}
+			col.SequenceRestart = restart
+		case "comment":
+			col.Comment = unquoteTagValue(value)
+		default:
+			return col, fmt.Errorf("unknown option %q in tag %q", key, tag)
+		}
+	}
+	if col.Name == "" {
+		col.Name = jsonName(field)
+	}
+	if col.Name == "" {
+		col.Name = snakeCase(field.Name)
+	}
+	if col.Datatype == "" {
+		datatype, err := postgresDatatype(field.Type)
+		if err != nil {
+			return col, err
+		}
+		col.Datatype = datatype
+	}
+	return col, nil
+}
+
+// splitTagOptions splits the tag on the semicolons that are outside single quoted literals and double quoted identifiers, so that a default such as 'a;b' is kept whole. A quote inside a literal is written twice, as in SQL
+func splitTagOptions(tag string) []string {
+	var options []string
+	var quote rune
+	start := 0
+	for i, r := range tag {
+		switch {
+		case quote != 0:
+			if r == quote {
+				// A doubled quote closes and reopens the literal, which leaves it open
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == ';':
+			options = append(options, tag[start:i])
+			start = i + 1
+		}
+	}
+	return append(options, tag[start:])
+}
+
+// unquoteTagValue returns the text of a value that is written as a single quoted literal, such as a comment that contains a semicolon. Other values are returned as they are
+func unquoteTagValue(value string) string {
+	if len(value) >= 2 && strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") {
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+	}
+	return value
+}
+
+// postgresDatatype maps a Go type to the PostgreSQL datatype that stores it
+func postgresDatatype(goType reflect.Type) (string, error) {
+	if goType.Kind() == reflect.Ptr {
+		goType = goType.Elem()
+	}
+	switch goType {
+	case timeType:
+		return "timestamp with time zone", nil
+	case rawMessageType:
+		return "jsonb", nil
+	case bytesType:
+		return "bytea", nil
+	}
+	if datatype, ok := nullTypes[goType]; ok {
+		return datatype, nil
+	}
+	if goType.Kind() == reflect.Struct && goType.PkgPath() == "database/sql" && strings.HasPrefix(goType.Name(), "Null[") {
+		// sql.Null[T] stores the value of type T in V
+		if field, ok := goType.FieldByName("V"); ok {
+			return postgresDatatype(field.Type)
+		}
+	}
+	if goType.Kind() == reflect.Struct && (goType.Implements(valuerType) || reflect.PointerTo(goType).Implements(valuerType) || reflect.PointerTo(goType).Implements(scannerType)) {
+		// Such types (pgtype.Text, uuid.UUID, etc.) are stored in the way their driver methods decide, which isn't jsonb
+		return "", fmt.Errorf("Go type %s implements driver.Valuer or sql.Scanner, so its PostgreSQL datatype can't be inferred, set it with the datatype option", goType)
+	}
+	switch goType.Kind() {
+	case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+		// The largest uint64 has 20 digits, which doesn't fit in a bigint
+		return "numeric(20)", nil
+	case reflect.Int, reflect.Int64, reflect.Uint32:
+		return "bigint", nil
+	case reflect.Int32, reflect.Uint16:
+		return "integer", nil
+	case reflect.Int8, reflect.Int16, reflect.Uint8:
+		return "smallint", nil
+	case reflect.Float64:
+		return "double precision", nil
+	case reflect.Float32:
+		return "real", nil
+	case reflect.String:
+		return "text", nil
+	case reflect.Bool:
+		return "boolean", nil
+	case reflect.Map, reflect.Struct:
+		return "jsonb", nil
+	case reflect.Slice, reflect.Array:
+		element, err := postgresDatatype(goType.Elem())
+		if err != nil {
+			return "", err
+		}
+		if element == "jsonb" {
+			// Slices of objects are stored as a single JSON array
+			return "jsonb", nil
+		}
+		return element + "[]", nil
+	}
+	return "", fmt.Errorf("no PostgreSQL datatype for Go type %s, set it with the datatype option", goType)
+}
+
+// jsonName returns the name of the field in its json tag, if any
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+// snakeCase converts a Go field name into snake_case. Eg.: TaxRatePercentage --> tax_rate_percentage, HTTPStatus --> http_status, ID --> id
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			startsWord := i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1]))
+			if startsWord {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -3,22 +3,45 @@ package schemamagic
 import (
 	"context"
 	"fmt"
+	"slices"
 
 	"strings"
+	"time"
 
 	pgx "github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	// pgx2 "gopkg.in/jackc/pgx.v2"
 )
 
+// Prune modes that decide what happens to the columns that exist in the table, but are not declared in Columns
+const (
+	PruneOff  = ""     // Undeclared columns are left untouched (default)
+	PruneWarn = "warn" // Undeclared columns are only reported in the log
+	PruneDrop = "drop" // Undeclared columns are dropped
+)
+
 // Table holds the table details as well as all the columns inside the table
 type Table struct {
-	Name          string
-	DefaultSchema string
-	Database      string
-	Tx            pgx.Tx
-	Autocommit    bool
-	Columns       []Column
-	constraints   []Constraint
+	Name            string
+	DefaultSchema   string
+	Database        string
+	Tx              pgx.Tx
+	Autocommit      bool
+	Columns         []Column
+	Comment         string        // Set on the table with COMMENT ON TABLE, whenever it differs from the description in the DB
+	PruneMode       string        // One of PruneOff, PruneWarn or PruneDrop
+	RecordHistory   bool          // Denotes if every executed statement needs to be recorded in the history table (HistoryTableName) in DefaultSchema
+	AppVersion      string        // Version of the application, which is recorded along with every statement in the history table
+	Lock            bool          // Denotes if an advisory lock (keyed on Database and DefaultSchema) needs to be held while migrating, so that concurrent instances don't migrate simultaneously
+	LockTimeout     time.Duration // Maximum time to wait for the lock. 0 waits until the context is done
+	DB              *pgxpool.Pool // Pool on which the statements that can't run inside a transaction (such as CREATE INDEX CONCURRENTLY) are executed by RunConcurrent
+	constraints     []Constraint
+	indexes         []Index
+	sequences       []Sequence
+	enums           []Enum
+	historyReady    bool
+	indexTableReady bool
+	concurrent      []PlannedStatement // Stores the statements of the last Begin that need to run outside the transaction
 }
 
 // NewTable creates and returns an instance of a postgres table
@@ -29,7 +52,14 @@ func NewTable(t Table) *Table {
 	table.Database = t.Database
 	table.Autocommit = t.Autocommit
 	table.Columns = t.Columns
+	table.Comment = t.Comment
 	table.Tx = t.Tx
+	table.PruneMode = t.PruneMode
+	table.RecordHistory = t.RecordHistory
+	table.AppVersion = t.AppVersion
+	table.Lock = t.Lock
+	table.LockTimeout = t.LockTimeout
+	table.DB = t.DB
 	return table
 }
 
@@ -43,165 +73,338 @@ func (t *Table) AddConstraint(constraint Constraint) {
 	t.constraints = append(t.constraints, constraint)
 }
 
-// Begin method initiates a DB transaction and checks if table (Name) exists in the DB. If it does, then it calls updateTable(). If it doesn't, it calls createTable(), and then updateTable()"""
-func (t *Table) Begin(ctx context.Context) {
+// Begin method initiates a DB transaction and checks if table (Name) exists in the DB. If it does, then it updates the table. If it doesn't, it creates the table, and then updates it. The statements that are executed are the ones returned by Plan().
+// The first failure is returned as a *MigrationError. The transaction is rolled back only if Autocommit is set, otherwise the caller decides whether to retry, roll back or abort.
+// Statements that can't run inside a transaction are held back, and are executed by RunConcurrent once the transaction has been committed (which Begin does by itself when Autocommit is set)
+func (t *Table) Begin(ctx context.Context) error {
 	log.Infoln("Operating on table --> ", t.Name)
-	// Create the schema here
-	schemaStatement := fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", t.DefaultSchema)
-	_, err := t.Tx.Exec(ctx, schemaStatement)
-	if err != nil {
-		t.Tx.Rollback(ctx)
-		log.Warningln("Couldn't create schema --> ", t.DefaultSchema, " with error being --> ", err)
+	err := t.apply(ctx)
+	if t.Autocommit {
+		if err != nil {
+			t.Tx.Rollback(ctx)
+			return err
+		}
+		if err := t.commit(ctx); err != nil {
+			return err
+		}
+		return t.RunConcurrent(ctx)
 	}
-	//  Check if table exists in the database
-	presence := t.checkTableExistence(ctx)
-	if !presence {
-		// Table does not exist --> need to create it
-		t.createTable(ctx)
+	return err
+}
+
+// apply plans the changes to the table and executes them on the transaction
+func (t *Table) apply(ctx context.Context) error {
+	t.concurrent = nil
+	if err := t.lock(ctx); err != nil {
+		return err
 	}
-	// Loop over all the available columns and call updateTable() on each column
-	for _, col := range t.Columns {
-		log.Debugln("-----------------------------------------------")
-		t.updateTable(ctx, col)
-		log.Debugln("-----------------------------------------------")
+	plan, err := t.Plan(ctx)
+	if err != nil {
+		return err
+	}
+	if !planChanges(plan) {
+		log.Infoln("Table --> ", t.Name, " is already in the declared state, skipping")
+		return nil
 	}
+	return t.execute(ctx, plan)
+}
 
-	// Iterate over the available constraints and apply them
-	for _, constraint := range t.constraints {
-		// 1. drop them first
-		dropRule := constraint.createDropRule(t.Name, t.DefaultSchema)
-		log.Debugln("Constraint drop rule is ", dropRule)
-		err := t.executeSQL(ctx, dropRule)
-		if err != nil {
-			log.Fatalln("While trying to drop constraint rule --> ", dropRule, "\n the error is ", err.Error())
+// execute executes the planned statements in order, and stops at the first failure. If RecordHistory is set, every executed statement is recorded in the history table.
+// The statements that need to run outside the transaction are held back for RunConcurrent, which needs DB, so the plan is refused before anything is executed if DB is not set
+func (t *Table) execute(ctx context.Context, plan []PlannedStatement) error {
+	if t.DB == nil {
+		for _, statement := range plan {
+			if statement.Concurrent {
+				log.Warningln("Statement --> ", statement.SQL, " needs to run outside the transaction, but DB is not set")
+				return statementError(statement, ErrNoDB)
+			}
 		}
-		// 2. add them
-		addRule := constraint.createAddRule(t.Name, t.DefaultSchema)
-		log.Debugln("Constraint add rule is ", addRule)
-		err = t.executeSQL(ctx, addRule)
-		if err != nil {
-			log.Fatalln("While trying to add constraint rule -->  ", addRule, "\n the error is ", err.Error())
+	}
+	if err := t.ensureIndexTable(ctx, plan); err != nil {
+		return err
+	}
+	var definitionHash string
+	if t.RecordHistory && len(plan) > 0 {
+		if err := t.ensureHistoryTable(ctx); err != nil {
+			return err
 		}
+		definitionHash = t.definitionHash()
 	}
-
-	if t.Autocommit {
-		t.commit(ctx)
+	for _, statement := range plan {
+		if statement.Concurrent {
+			t.concurrent = append(t.concurrent, statement)
+			continue
+		}
+		started := time.Now()
+		if err := t.executeSQL(ctx, statement.SQL); err != nil {
+			log.Warningln("Statement --> ", statement.SQL, " could not be executed because of error --> ", err)
+			return statementError(statement, err)
+		}
+		if t.RecordHistory {
+			if err := t.recordHistory(ctx, t.Tx, statement, time.Since(started), definitionHash); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
 }
 
 // checkTableExistence returns if the table already exists in the DB
-func (t *Table) checkTableExistence(ctx context.Context) bool {
+func (t *Table) checkTableExistence(ctx context.Context) (bool, error) {
 	var presence bool
-	statement := fmt.Sprintf(`
+	statement := `
 		SELECT EXISTS (
 			SELECT 1 
 			FROM pg_catalog.pg_class c
 			JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
-			WHERE n.nspname = '%s' -- schema
-			AND c.relname = '%s'  -- table
+			WHERE n.nspname = $1 -- schema
+			AND c.relname = $2  -- table
 			AND c.relkind = 'r'                  -- 'r' = ordinary table
 		)
-	`, t.DefaultSchema, t.Name)
+	`
 
-	err := t.Tx.QueryRow(ctx, statement).Scan(&presence)
+	err := t.Tx.QueryRow(ctx, statement, t.DefaultSchema, t.Name).Scan(&presence)
 	if err != nil {
-		t.Tx.Rollback(ctx)
 		log.Warningln("While querying for table existence, error is --> ", err)
+		return false, &MigrationError{Table: t.Name, SQL: statement, Err: err}
 	}
 	log.Debugln("While checking for table existence, presence is ", presence)
-	return presence
+	return presence, nil
 }
 
-// createTable method creates the table in the particular DB
-func (t *Table) createTable(ctx context.Context) {
-	statement := fmt.Sprintf("CREATE TABLE %s.%s()", t.DefaultSchema, t.Name)
-	err := t.executeSQL(ctx, statement)
+// DropTable method drops the table from the DB. The failure, if any, is returned as a *MigrationError
+func (t *Table) DropTable(ctx context.Context) error {
+	presence, err := t.checkTableExistence(ctx)
 	if err != nil {
-		t.Tx.Rollback(ctx)
-		log.Warningln("While creating table --> ", t.Name, " error is --> ", err)
+		return err
 	}
-}
-
-// DropTable method drops the table from the DB
-func (t *Table) DropTable(ctx context.Context) {
-	presence := t.checkTableExistence(ctx)
 	if presence {
 		// Drop the table here
 		log.Infoln("Trying to drop table --> ", t.Name)
-		statement := fmt.Sprintf("DROP TABLE %s.%s", t.DefaultSchema, t.Name)
+		statement := fmt.Sprintf("DROP TABLE %s", qualifiedName(t.DefaultSchema, t.Name))
 		err := t.executeSQL(ctx, statement)
 		if err != nil {
-			t.Tx.Rollback(ctx)
 			log.Warningln("While dropping table --> ", t.Name, " error is --> ", err)
-		} else {
-			log.Infoln("Successfully dropped table --> ", t.Name)
+			return &MigrationError{Table: t.Name, SQL: statement, Err: err}
 		}
+		log.Infoln("Successfully dropped table --> ", t.Name)
 	}
+	return nil
 }
 
-// updateTable alters the table by adding a new column to it, passed as the method parameter
-func (t *Table) updateTable(ctx context.Context, col Column) {
+// planColumn returns the statements that alter the table by adding the column passed as the method parameter, or by updating it if it already exists
+func (t *Table) planColumn(ctx context.Context, col Column) ([]PlannedStatement, error) {
+	var plan []PlannedStatement
 	var steps = make([]int, 0)
-	columnPresence := t.checkColumnPresence(ctx, col.Name)
-	if columnPresence {
+	if err := col.validateBackfill(); err != nil {
+		return nil, &MigrationError{Table: t.Name, Column: col.Name, Step: StepBackfillDefault, Err: err}
+	}
+	if err := col.validateIdentity(); err != nil {
+		return nil, &MigrationError{Table: t.Name, Column: col.Name, Step: StepIdentity, Err: err}
+	}
+	if err := col.validateSequence(); err != nil {
+		return nil, &MigrationError{Table: t.Name, Column: col.Name, Step: StepSequenceOptions, Err: err}
+	}
+	columnPresence, err := t.checkColumnPresence(ctx, col.Name)
+	if err != nil {
+		return nil, err
+	}
+	// previousName stores the name under which the column currently exists, in case it needs to be renamed
+	previousName := ""
+	// state stores the current default and nullability of an existing column
+	var state columnState
+	if !columnPresence && col.Action != ActionDrop {
+		// Check if the column exists under one of its previous names, in which case it's renamed
+		plan, previousName, err = t.planRename(ctx, col)
+		if err != nil {
+			return nil, err
+		}
+		columnPresence = previousName != ""
+	}
+	if col.Action == ActionDrop {
+		// The column needs to be dropped, which is required only if it still exists
+		if columnPresence {
+			log.Debugln("Column --> ", col.Name, " needs to be dropped")
+			steps = []int{StepDropColumn}
+		}
+	} else if columnPresence {
 		log.Debugln("Column --> ", col.Name, " already exists")
-		columnDatatypeMatch := t.checkColumnDatatype(ctx, col)
+		existing := col
+		if previousName != "" {
+			// The column is yet to be renamed, so its datatype is checked under the previous name
+			existing.Name = previousName
+		}
+		columnDatatypeMatch, err := t.checkColumnDatatype(ctx, existing)
+		if err != nil {
+			return nil, err
+		}
 		log.Debugln("Column --> ", col.Name, " datatype match value is --> ", columnDatatypeMatch)
-		if columnDatatypeMatch {
-			// Do nothing
-		} else {
-			// If the datatype does not match, then step=101, and set minNumberOfSteps to 1, since the step=1 has already been executed in the form of datatype modificaton
-			statement, statementErr := col.prepareSQLStatement(101, t.Name, t.DefaultSchema, columnPresence)
-			if statementErr != nil {
-				err := t.executeSQL(ctx, statement)
-				if err != nil {
-					t.Tx.Rollback(ctx)
-					log.Warningln("While executing SQL --> \n", statement, "\nerror is ", err)
-				}
+		if !columnDatatypeMatch {
+			// If the datatype does not match, then the datatype needs to be modified first (step=101)
+			steps = append(steps, StepAlterDatatype)
+		}
+		state, err = t.fetchColumnState(ctx, existing.Name)
+		if err != nil {
+			return nil, err
+		}
+		if previousName == "" {
+			// Bring the default, nullability and constraints down to the declaration, in case the flags have been removed
+			removed, err := t.removedFlagSteps(ctx, col, state)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, removed...)
+		}
+		steps = append(steps, StepIdentity, StepSequenceOptions, StepRestartSequence)
+		if col.DefaultExists {
+			// The default is set (and the existing rows backfilled, as per the backfill policy) only if it has changed
+			if t.defaultChanged(col, state) {
+				steps = append(steps, StepSetDefault, StepBackfillDefault)
 			}
 		}
 		// Run these steps to check for other updates
-		steps = []int{2, 3, 5, 7, 8}
+		steps = append(steps, StepUnique, StepNotNull, StepIndex, StepComment)
 	} else {
 		// Column does not exist
-		// DefaultExists -> 2
-		// DefaultValue -> 3
-		// IsUnique -> 5
-		// IsPrimary -> 6
-		// IsNotNull -> 7
-		// IndexRequired -> 8
 		log.Debugln("Column --> ", col.Name, " does not exist")
-		steps = []int{1, 2, 3, 4, 5, 6, 7, 8}
+		steps = []int{StepAddColumn, StepSequenceOptions, StepRestartSequence, StepUnique, StepPrimaryKey, StepNotNull, StepIndex, StepComment}
 	}
 
-	//  There are 4 steps involved here.
-
-	// The first step is to call col.prepareSQLStatement with a step=1, which would return an SQL statement that would be used
-	// to alter the table structure with a default set to NULL -> this is a very cheap operation,
-	//  since the access exclusive lock would be acquired for a short time.
-
-	//  The second step is to call col.prepareSQLStatement with a step=2, which would return an SQL statement that would be used
-	//  to set the defaults to Column.default_value. In case Column.default_exists is False, then it returns an empty statement.
-	//  This can be checked before executing the statement
+	//  The first step is to call col.prepareSQLStatement with a step=1, which would return an SQL statement that would be used
+	// to alter the table structure along with the default value -> since PostgreSQL 11, this is a metadata only change for non-volatile defaults,
+	//  so the access exclusive lock would be acquired for a short time, and the existing rows are not rewritten.
 
-	//  The third step is to call col.prepareSQLStatement with a step=3, which would update all the rows in the table with the default
-	//  value.
+	//  For existing columns, step=2 sets the default to Column.DefaultValue if it has changed, and step=3 updates the existing rows
+	//  as per Column.Backfill. Empty statements are not added to the plan.
 
-	//  The fourth step is to call col.prepareSQLStatement with a step=3, which would return an SQL statement that would be used to
-	//  alter the sequence start, in case the datatype is serial/bigserial. Similar to step=2, if it returns an empty statement,
-	//  it either means that the datatype doesn't support a sequence, or the sequence needs to begin at 0.
+	//  The fourth step is to call col.prepareSQLStatement with a step=4, which would return an SQL statement that would be used to
+	//  restart the sequence, in case the column is backed by one (serial/bigserial or identity), which is resolved with pg_get_serial_sequence.
+	//  If it returns an empty statement, it either means that the column doesn't have a sequence, or that SequenceRestart is 0.
+	existingName := col.Name
+	if previousName != "" {
+		existingName = previousName
+	}
+	filled := col.filledBeforeNotNull(columnPresence, steps)
 	for _, step := range steps {
-		// for step := minNumberOfSteps; step < maxNumberOfSteps; step++ {
-		statement, statementErr := col.prepareSQLStatement(step, t.Name, t.DefaultSchema, columnPresence)
-		log.Debugln("In steps, statement is \n", statement, " and error is ", statementErr)
-		if statementErr == nil {
-			err := t.executeSQL(ctx, statement)
+		if step == StepAlterDatatype {
+			// The change is classified, and refused if it isn't safe
+			typePlan, err := t.planTypeChange(ctx, col, existingName)
 			if err != nil {
-				t.Tx.Rollback(ctx)
-				log.Warningln("Statement --> ", statement, " could not be executed because of error --> ", err)
+				return nil, err
 			}
+			plan = append(plan, typePlan...)
+			continue
+		}
+		if step == StepIdentity {
+			identityPlan, err := t.planIdentity(ctx, col, existingName, state)
+			if err != nil {
+				return nil, err
+			}
+			plan = append(plan, identityPlan...)
+			continue
+		}
+		if step == StepSequenceOptions {
+			sequencePlan, err := t.planSequenceOptions(ctx, col, existingName, columnPresence)
+			if err != nil {
+				return nil, err
+			}
+			plan = append(plan, sequencePlan...)
+			continue
+		}
+		if step == StepComment {
+			commentPlan, err := t.planColumnComment(ctx, col, existingName, columnPresence)
+			if err != nil {
+				return nil, err
+			}
+			plan = append(plan, commentPlan...)
+			continue
+		}
+		if step == StepNotNull {
+			notNullPlan, err := t.planNotNull(ctx, col, existingName, columnPresence, state.notNull, filled)
+			if err != nil {
+				return nil, err
+			}
+			plan = append(plan, notNullPlan...)
+			continue
+		}
+		if step == StepUnique && col.IsUnique && columnPresence && previousName == "" {
+			// The unique constraint is re-created only if its definition has changed
+			_, match, err := t.checkConstraintDefinition(ctx, col.uniqueConstraint(t.Name))
+			if err != nil {
+				return nil, err
+			}
+			if match {
+				continue
+			}
+		}
+		if step == StepBackfillDefault {
+			backfillPlan, err := t.planBackfill(ctx, col)
+			if err != nil {
+				return nil, err
+			}
+			plan = append(plan, backfillPlan...)
+			continue
+		}
+		if step == StepIndex {
+			// The existing index is compared with the declaration, and is rebuilt or dropped to match it
+			indexPlan, err := t.planColumnIndex(ctx, col, columnPresence)
+			if err != nil {
+				return nil, err
+			}
+			plan = append(plan, indexPlan...)
+			continue
+		}
+		statement, statementErr := col.prepareSQLStatement(step, t.Name, t.DefaultSchema, columnPresence)
+		log.Debugln("In steps, statement is \n", statement, " and error is ", statementErr)
+		if statementErr != nil {
+			return nil, &MigrationError{Table: t.Name, Column: col.Name, Step: step, Err: statementErr}
+		}
+		if statement != "" {
+			plan = append(plan, PlannedStatement{Table: t.Name, Column: col.Name, Step: step, SQL: statement})
+		}
+	}
+	return plan, nil
+}
+
+// planRename looks for the column under each of its previous names. If one of them exists, the statements that rename it are returned, along with the previous name
+func (t *Table) planRename(ctx context.Context, col Column) ([]PlannedStatement, string, error) {
+	from, err := t.findPreviousName(ctx, col)
+	if err != nil || from == "" {
+		return nil, "", err
+	}
+	log.Debugln("Column --> ", col.Name, " exists as --> ", from, " and needs to be renamed")
+	uniquePresent, err := t.checkConstraintPresence(ctx, uniqueConstraintName(t.Name, from))
+	if err != nil {
+		return nil, "", err
+	}
+	primaryPresent, err := t.checkConstraintPresence(ctx, primaryKeyName(t.Name, from))
+	if err != nil {
+		return nil, "", err
+	}
+	// The foreign key is renamed as well, so that it's found under the new name, instead of a second one being added
+	foreignKeyPresent, err := t.checkConstraintPresence(ctx, foreignKeyName(t.Name, from))
+	if err != nil {
+		return nil, "", err
+	}
+	var plan []PlannedStatement
+	for _, statement := range col.prepareRenameStatements(from, t.Name, t.DefaultSchema, uniquePresent, primaryPresent, foreignKeyPresent) {
+		plan = append(plan, PlannedStatement{Table: t.Name, Column: col.Name, Step: StepRenameColumn, SQL: statement})
+	}
+	return plan, from, nil
+}
+
+// findPreviousName returns the first of the previous names of the column under which it exists in the table, or an empty string if there's none
+func (t *Table) findPreviousName(ctx context.Context, col Column) (string, error) {
+	for _, from := range col.RenamedFrom {
+		presence, err := t.checkColumnPresence(ctx, from)
+		if err != nil {
+			return "", err
+		}
+		if presence {
+			return from, nil
 		}
 	}
+	return "", nil
 }
 
 // executeSQL executes the SQL query
@@ -216,21 +419,75 @@ func (t *Table) executeSQL(ctx context.Context, sql string) error {
 }
 
 // checkColumnPresence checks if the column name passed is present in the current table
-func (t *Table) checkColumnPresence(ctx context.Context, columnName string) bool {
+func (t *Table) checkColumnPresence(ctx context.Context, columnName string) (bool, error) {
 	var presence bool
-	statement := fmt.Sprintf("SELECT EXISTS(SELECT column_name FROM INFORMATION_SCHEMA.COLUMNS WHERE table_name = '%s' AND table_catalog = '%s' AND column_name = '%s' AND table_schema = '%s')", t.Name, t.Database, columnName, t.DefaultSchema)
+	statement := "SELECT EXISTS(SELECT column_name FROM INFORMATION_SCHEMA.COLUMNS WHERE table_name = $1 AND table_catalog = $2 AND column_name = $3 AND table_schema = $4)"
 	log.Debugln("Statement in checkColumnPresence is: \n", statement)
-	err := t.Tx.QueryRow(ctx, statement).Scan(&presence)
+	err := t.Tx.QueryRow(ctx, statement, t.Name, t.Database, columnName, t.DefaultSchema).Scan(&presence)
 	if err != nil {
-		t.Tx.Rollback(ctx)
 		log.Warningln("In checkColumnPresence, error for table --> ", t.Name, " and Column --> ", columnName, " is ", err)
+		return false, &MigrationError{Table: t.Name, Column: columnName, SQL: statement, Err: err}
 	}
 	log.Debugln("Presence is ", presence)
-	return presence
+	return presence, nil
+}
+
+// checkConstraintPresence checks if a constraint with the name passed exists on the current table
+func (t *Table) checkConstraintPresence(ctx context.Context, constraintName string) (bool, error) {
+	var presence bool
+	statement := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM pg_catalog.pg_constraint con
+			JOIN pg_catalog.pg_class c ON c.oid = con.conrelid
+			JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+			WHERE n.nspname = $1 AND c.relname = $2 AND con.conname = $3
+		)
+	`
+	err := t.Tx.QueryRow(ctx, statement, t.DefaultSchema, t.Name, constraintName).Scan(&presence)
+	if err != nil {
+		log.Warningln("In checkConstraintPresence, error for table --> ", t.Name, " and Constraint --> ", constraintName, " is ", err)
+		return false, &MigrationError{Table: t.Name, Constraint: constraintName, SQL: statement, Err: err}
+	}
+	log.Debugln("Constraint --> ", constraintName, " presence is ", presence)
+	return presence, nil
+}
+
+// UndeclaredColumns returns the names of the columns that exist in the table in the DB, but are not declared in Columns
+func (t *Table) UndeclaredColumns(ctx context.Context) ([]string, error) {
+	declared := make(map[string]bool)
+	for _, col := range t.Columns {
+		declared[col.Name] = true
+		// The previous names are handled by the rename, and must not be pruned
+		for _, from := range col.RenamedFrom {
+			declared[from] = true
+		}
+	}
+	statement := "SELECT column_name FROM INFORMATION_SCHEMA.COLUMNS WHERE table_name = $1 AND table_catalog = $2 AND table_schema = $3 ORDER BY ordinal_position"
+	rows, err := t.Tx.Query(ctx, statement, t.Name, t.Database, t.DefaultSchema)
+	if err != nil {
+		return nil, &MigrationError{Table: t.Name, SQL: statement, Err: err}
+	}
+	defer rows.Close()
+	var undeclared []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, &MigrationError{Table: t.Name, SQL: statement, Err: err}
+		}
+		if !declared[name] {
+			undeclared = append(undeclared, name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &MigrationError{Table: t.Name, SQL: statement, Err: err}
+	}
+	log.Debugln("Undeclared columns in table --> ", t.Name, " are ", undeclared)
+	return undeclared, nil
 }
 
 // checkColumnDatatype checks if the column datatype of the column name passed is equal to the column datatype present in the table
-func (t *Table) checkColumnDatatype(ctx context.Context, col Column) bool {
+func (t *Table) checkColumnDatatype(ctx context.Context, col Column) (bool, error) {
 	columnName := col.Name
 	columnDatatype := col.Datatype
 	columnDefault := col.DefaultValue
@@ -239,12 +496,12 @@ func (t *Table) checkColumnDatatype(ctx context.Context, col Column) bool {
 		columnDefaultDB *string
 		presence        bool
 	)
-	statement := fmt.Sprintf("SELECT data_type, column_default FROM INFORMATION_SCHEMA.COLUMNS WHERE table_name = '%s' AND table_catalog = '%s' AND column_name = '%s' AND table_schema = '%s'", t.Name, t.Database, columnName, t.DefaultSchema)
+	statement := "SELECT data_type, column_default FROM INFORMATION_SCHEMA.COLUMNS WHERE table_name = $1 AND table_catalog = $2 AND column_name = $3 AND table_schema = $4"
 
-	err := t.Tx.QueryRow(ctx, statement).Scan(&dbDatatype, &columnDefaultDB)
+	err := t.Tx.QueryRow(ctx, statement, t.Name, t.Database, columnName, t.DefaultSchema).Scan(&dbDatatype, &columnDefaultDB)
 	if err != nil {
-		t.Tx.Rollback(ctx)
 		log.Warningln("While querying for column data type in table --> ", t.Name, " error is --> ", err)
+		return false, &MigrationError{Table: t.Name, Column: columnName, SQL: statement, Err: err}
 	}
 
 	log.Debugln("Datatype DB is ", dbDatatype, " and ColumnDefaultDB is ", columnDefaultDB, " and ColumnDefault is ", columnDefault, " and Column Datatype is ", columnDatatype)
@@ -291,13 +548,96 @@ func (t *Table) checkColumnDatatype(ctx context.Context, col Column) bool {
 	}
 
 	log.Debugln("In check column datatype, the value of presence is ", presence)
-	return presence
+	return presence, nil
 }
 
-func (t *Table) commit(ctx context.Context) {
+// columnState is the default, nullability and primary key membership of an existing column, as read from pg_catalog
+type columnState struct {
+	notNull      bool
+	defaultValue string // Empty when the column has no default
+	identity     string // 'a' (ALWAYS) or 'd' (BY DEFAULT) for identity columns, empty otherwise
+	generated    string // 's' for generated columns, empty otherwise
+	inPrimaryKey bool   // Denotes if the column is part of the primary key of the table
+}
+
+// fetchColumnState reads the current default, nullability and primary key membership of the column
+func (t *Table) fetchColumnState(ctx context.Context, columnName string) (columnState, error) {
+	var state columnState
+	statement := `
+		SELECT a.attnotnull, coalesce(pg_get_expr(d.adbin, d.adrelid), ''), a.attidentity::text, a.attgenerated::text,
+			EXISTS (SELECT 1 FROM pg_catalog.pg_constraint con WHERE con.conrelid = c.oid AND con.contype = 'p' AND a.attnum = ANY(con.conkey))
+		FROM pg_catalog.pg_attribute a
+		JOIN pg_catalog.pg_class c ON c.oid = a.attrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_catalog.pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE n.nspname = $1 AND c.relname = $2 AND a.attname = $3 AND NOT a.attisdropped
+	`
+	err := t.Tx.QueryRow(ctx, statement, t.DefaultSchema, t.Name, columnName).Scan(&state.notNull, &state.defaultValue, &state.identity, &state.generated, &state.inPrimaryKey)
+	if err != nil {
+		log.Warningln("While querying for the state of column --> ", columnName, " in table --> ", t.Name, " error is --> ", err)
+		return state, &MigrationError{Table: t.Name, Column: columnName, SQL: statement, Err: err}
+	}
+	log.Debugln("State of column --> ", columnName, " is ", state)
+	return state, nil
+}
+
+// filledBeforeNotNull returns if the rows of the column are filled with the default value before NOT NULL is set, so that they don't need to be counted for NULLs.
+// A batched backfill runs after the commit, so it fills the rows first only when NOT NULL is set after the commit as well, with SafeNotNull
+func (c *Column) filledBeforeNotNull(columnPresence bool, steps []int) bool {
+	if !columnPresence {
+		return c.DefaultExists || c.Identity != ""
+	}
+	if !c.DefaultExists || c.Backfill == BackfillNever || !slices.Contains(steps, StepBackfillDefault) {
+		return false
+	}
+	return c.BackfillBatchSize == 0 || c.SafeNotNull
+}
+
+// removedFlagSteps compares the existing column with the declaration, and returns the steps that drop the unique constraint, the primary key, the default and NOT NULL when the corresponding flags are no longer set.
+// The defaults and NOT NULL of serial, identity and generated columns are left alone, and NOT NULL is kept on the columns of a primary key that is not being dropped
+func (t *Table) removedFlagSteps(ctx context.Context, col Column, state columnState) ([]int, error) {
+	var steps []int
+	if !col.IsUnique {
+		present, err := t.checkConstraintPresence(ctx, uniqueConstraintName(t.Name, col.Name))
+		if err != nil {
+			return nil, err
+		}
+		if present {
+			steps = append(steps, StepDropUnique)
+		}
+	}
+	primaryDropped := false
+	if !col.IsPrimary {
+		present, err := t.checkConstraintPresence(ctx, primaryKeyName(t.Name, col.Name))
+		if err != nil {
+			return nil, err
+		}
+		if present {
+			steps = append(steps, StepDropPrimaryKey)
+			primaryDropped = true
+		}
+	}
+	serial := strings.HasPrefix(state.defaultValue, "nextval(")
+	if !col.DefaultExists && state.defaultValue != "" && state.identity == "" && state.generated == "" && !serial {
+		steps = append(steps, StepDropDefault)
+	}
+	if !col.IsNotNull && !col.IsPrimary && state.notNull && state.identity == "" && !serial {
+		if state.inPrimaryKey && !primaryDropped {
+			log.Debugln("Column --> ", col.Name, " is part of the primary key, so NOT NULL is kept")
+		} else {
+			steps = append(steps, StepDropNotNull)
+		}
+	}
+	return steps, nil
+}
+
+// commit commits the transaction of the table, which is done only when Autocommit is set
+func (t *Table) commit(ctx context.Context) error {
 	commitErr := t.Tx.Commit(ctx)
 	if commitErr != nil {
 		t.Tx.Rollback(ctx)
 		log.Warningln("Couldn't commit changes to the TABLE --> ", t.Name, " with error being --> ", commitErr)
+		return &MigrationError{Table: t.Name, SQL: "COMMIT", Err: commitErr}
 	}
+	return nil
 }
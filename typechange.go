@@ -0,0 +1,185 @@
+package schemamagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	pgx "github.com/jackc/pgx/v5"
+)
+
+// Classes of a change of the datatype of an existing column
+const (
+	TypeChangeNone            = "none"             // The declared datatype is the current one, written differently
+	TypeChangeBinaryCoercible = "binary-coercible" // The values are stored the same way, so nothing is rewritten (varchar --> text)
+	TypeChangeWidening        = "widening"         // The type modifier is relaxed, so nothing is rewritten (varchar(20) --> varchar(50))
+	TypeChangeNarrowing       = "narrowing"        // The type modifier is tightened, so every row is checked, and the change fails on the values that don't fit (varchar(50) --> varchar(20))
+	TypeChangeRewrite         = "rewrite"          // Every value can be converted, but the table is rewritten under an ACCESS EXCLUSIVE lock (integer --> bigint)
+	TypeChangeLossy           = "lossy"            // The conversion can lose information or fail on the existing data (text --> bigint, double precision --> integer)
+)
+
+// TypeChangeError is returned (wrapped in a *MigrationError) when the datatype of a column would be changed in a way that isn't safe, and the column doesn't set AllowUnsafeTypeChange
+type TypeChangeError struct {
+	From  string // Current datatype of the column
+	To    string // Declared datatype of the column
+	Class string // One of TypeChangeNarrowing, TypeChangeRewrite or TypeChangeLossy
+}
+
+// Error returns the description of the refused change
+func (e *TypeChangeError) Error() string {
+	return fmt.Sprintf("changing the datatype from %s to %s is a %s change, set AllowUnsafeTypeChange on the column to apply it", e.From, e.To, e.Class)
+}
+
+// safeTypeChange returns if the class of change can be applied without the column opting in
+func safeTypeChange(class string) bool {
+	return class == TypeChangeBinaryCoercible || class == TypeChangeWidening
+}
+
+// datatype is a type along with its type modifier, as stored in pg_attribute
+type datatype struct {
+	oid    uint32
+	typmod int32
+	name   string
+}
+
+// planTypeChange classifies the change from the current datatype of the column to the declared one, and returns the statement that applies it. Changes that are neither binary-coercible nor widening are refused, unless the column sets AllowUnsafeTypeChange.
+// Safe changes are applied without a USING clause, so that PostgreSQL can skip rewriting the table. Lossy changes use the Using expression of the column, or an explicit cast
+func (t *Table) planTypeChange(ctx context.Context, col Column, existingName string) ([]PlannedStatement, error) {
+	// The explicit conversion also refuses the changes to serial datatypes, which are not real types
+	explicit, err := col.prepareSQLStatement(StepAlterDatatype, t.Name, t.DefaultSchema, true)
+	if err != nil {
+		return nil, &MigrationError{Table: t.Name, Column: col.Name, Step: StepAlterDatatype, Err: err}
+	}
+	from, to, err := t.fetchDatatypes(ctx, existingName, col)
+	if err != nil {
+		return nil, err
+	}
+	class, err := t.classifyTypeChange(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugln("Changing the datatype of column --> ", col.Name, " from --> ", from.name, " to --> ", to.name, " is a ", class, " change")
+	if class == TypeChangeNone {
+		return nil, nil
+	}
+	if !safeTypeChange(class) && !col.AllowUnsafeTypeChange {
+		return nil, &MigrationError{Table: t.Name, Column: col.Name, Step: StepAlterDatatype, Err: &TypeChangeError{From: from.name, To: to.name, Class: class}}
+	}
+	statement := fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s", qualifiedName(t.DefaultSchema, t.Name), quoteIdentifier(col.Name), col.Datatype)
+	if class == TypeChangeLossy || col.Using != "" {
+		statement = explicit
+	}
+	return []PlannedStatement{{Table: t.Name, Column: col.Name, Step: StepAlterDatatype, SQL: statement}}, nil
+}
+
+// fetchDatatypes returns the current datatype of the column, and the declared one. The declared datatype is resolved by PostgreSQL, by casting NULL to it inside a savepoint, so that an invalid datatype doesn't abort the transaction
+func (t *Table) fetchDatatypes(ctx context.Context, columnName string, col Column) (datatype, datatype, error) {
+	var from, to datatype
+	statement := `
+		SELECT a.atttypid, a.atttypmod, format_type(a.atttypid, a.atttypmod)
+		FROM pg_catalog.pg_attribute a
+		JOIN pg_catalog.pg_class c ON c.oid = a.attrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1 AND c.relname = $2 AND a.attname = $3 AND NOT a.attisdropped
+	`
+	if err := t.Tx.QueryRow(ctx, statement, t.DefaultSchema, t.Name, columnName).Scan(&from.oid, &from.typmod, &from.name); err != nil {
+		return from, to, &MigrationError{Table: t.Name, Column: col.Name, SQL: statement, Err: err}
+	}
+	savepoint, err := t.Tx.Begin(ctx)
+	if err != nil {
+		return from, to, &MigrationError{Table: t.Name, Column: col.Name, SQL: "SAVEPOINT", Err: err}
+	}
+	defer savepoint.Rollback(ctx)
+	statement = fmt.Sprintf("SELECT NULL::%s", col.Datatype)
+	rows, err := savepoint.Query(ctx, statement)
+	if err == nil {
+		fields := rows.FieldDescriptions()
+		if len(fields) == 1 {
+			to.oid, to.typmod = fields[0].DataTypeOID, fields[0].TypeModifier
+		}
+		rows.Close()
+		err = rows.Err()
+	}
+	if err != nil {
+		return from, to, &MigrationError{Table: t.Name, Column: col.Name, Step: StepAlterDatatype, SQL: statement, Err: err}
+	}
+	statement = "SELECT format_type($1, $2)"
+	if err := savepoint.QueryRow(ctx, statement, to.oid, to.typmod).Scan(&to.name); err != nil {
+		return from, to, &MigrationError{Table: t.Name, Column: col.Name, SQL: statement, Err: err}
+	}
+	return from, to, nil
+}
+
+// classifyTypeChange returns the class of the change between the two datatypes. A change of the type modifier alone is classified by classifyTypmodChange, otherwise the cast between the types in pg_cast decides the class:
+// a binary-coercible cast (castmethod b) doesn't rewrite the table, an implicit cast (castcontext i) preserves the values, and an assignment or explicit cast (or a conversion through text) may lose them
+func (t *Table) classifyTypeChange(ctx context.Context, from datatype, to datatype) (string, error) {
+	if from.oid == to.oid {
+		return classifyTypmodChange(from, to), nil
+	}
+	var method, castContext string
+	statement := "SELECT castmethod::text, castcontext::text FROM pg_catalog.pg_cast WHERE castsource = $1 AND casttarget = $2"
+	err := t.Tx.QueryRow(ctx, statement, from.oid, to.oid).Scan(&method, &castContext)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return TypeChangeLossy, nil
+	}
+	if err != nil {
+		return "", &MigrationError{Table: t.Name, SQL: statement, Err: err}
+	}
+	switch {
+	case method == "b" && to.typmod != -1:
+		// Such as text --> varchar(20), where every value is checked against the length
+		return TypeChangeNarrowing, nil
+	case method == "b":
+		return TypeChangeBinaryCoercible, nil
+	case castContext == "i":
+		return TypeChangeRewrite, nil
+	}
+	return TypeChangeLossy, nil
+}
+
+// numericOID is the oid of the numeric type, whose type modifier holds both the precision and the scale
+const numericOID = 1700
+
+// Oids of the types whose type modifier PostgreSQL can relax without rewriting the table or checking the values
+const (
+	varcharOID     = 1043
+	varbitOID      = 1562
+	timeOID        = 1083
+	timestampOID   = 1114
+	timestamptzOID = 1184
+	timetzOID      = 1266
+)
+
+// bpcharOID is the oid of char(n), whose values are padded to the length, so that a longer length rewrites them
+const bpcharOID = 1042
+
+// classifyTypmodChange returns the class of the change of the type modifier of a type. Removing the modifier or making it larger is widening only for varchar, varbit, numeric and the precision of timestamp and time, which PostgreSQL applies without touching the rows.
+// For numeric, the precision can only grow while the scale stays the same. Lengthening char(n) pads every value, so it's a rewrite, and every other change (such as for bit(n) or interval) is narrowing
+func classifyTypmodChange(from datatype, to datatype) string {
+	if from.typmod == to.typmod {
+		return TypeChangeNone
+	}
+	switch from.oid {
+	case varcharOID, varbitOID, timeOID, timestampOID, timestamptzOID, timetzOID:
+		if to.typmod == -1 || from.typmod != -1 && to.typmod > from.typmod {
+			return TypeChangeWidening
+		}
+	case numericOID:
+		if to.typmod == -1 {
+			return TypeChangeWidening
+		}
+		if from.typmod == -1 {
+			return TypeChangeNarrowing
+		}
+		fromPrecision, fromScale := (from.typmod-4)>>16, (from.typmod-4)&0xffff
+		toPrecision, toScale := (to.typmod-4)>>16, (to.typmod-4)&0xffff
+		if toScale == fromScale && toPrecision >= fromPrecision {
+			return TypeChangeWidening
+		}
+	case bpcharOID:
+		if from.typmod != -1 && (to.typmod == -1 || to.typmod > from.typmod) {
+			return TypeChangeRewrite
+		}
+	}
+	return TypeChangeNarrowing
+}